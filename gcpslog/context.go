@@ -0,0 +1,32 @@
+package gcpslog
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+)
+
+type attrsContextKeyType struct{}
+
+var attrsContextKey = attrsContextKeyType{}
+
+// ContextWithAttrs returns a copy of ctx with attrs that are added to every
+// record logged with it, in addition to any attributes added by parent
+// contexts. This allows recording attributes such as a request ID with every
+// log for a request without passing around a logger. The attributes are
+// handled as if they were passed to the logging call, after its own
+// attributes.
+func ContextWithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	if len(attrs) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, attrsContextKey, append(slices.Clip(attrsFromContext(ctx)), attrs...))
+}
+
+func attrsFromContext(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(attrsContextKey).([]slog.Attr)
+	return attrs
+}
@@ -0,0 +1,37 @@
+package gcpslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextWithAttrs(t *testing.T) {
+	var out bytes.Buffer
+	l := slog.New(NewHandler(&out)).WithGroup("g")
+
+	ctx := ContextWithAttrs(t.Context(), slog.String("requestId", "1234"))
+	ctx = ContextWithAttrs(ctx, slog.String("animal", "bear"))
+	require.Equal(t, ctx, ContextWithAttrs(ctx))
+
+	l.InfoContext(ctx, "context attrs", "color", "brown")
+	l.InfoContext(t.Context(), "no context attrs")
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal(lines[0], &rec))
+	require.Equal(t, map[string]any{
+		"color":     "brown",
+		"requestId": "1234",
+		"animal":    "bear",
+	}, rec["g"])
+
+	rec = nil
+	require.NoError(t, json.Unmarshal(lines[1], &rec))
+	require.NotContains(t, rec, "g")
+}
@@ -0,0 +1,326 @@
+package gcpslog
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// To reduce peak allocation, buffers larger than this are not returned to
+// the pool.
+const maxBufferSize = 16 << 10
+
+var buffers = sync.Pool{New: func() any {
+	buf := make([]byte, 0, 1024)
+	return &buf
+}}
+
+// encoder writes records as JSON with GCP's keys directly to a writer,
+// without the intermediate attributes and closures needed to adapt
+// slog.JSONHandler. It is immutable, with withAttrs and withGroup returning
+// copies that share the writer.
+type encoder struct {
+	w  io.Writer
+	mu *sync.Mutex
+
+	level              slog.Leveler
+	addSource          bool
+	trimSourcePath     bool
+	sourceRoots        []string
+	trimSourceFunction bool
+	replaceAttr        func([]string, slog.Attr) slog.Attr
+	redactProto        func(protoreflect.FieldDescriptor) bool
+	insertID           insertIDMode
+	tracePrefix        string
+
+	// preformatted is the encoded attributes added with withAttrs, including
+	// the opening of any groups that contain them.
+	preformatted []byte
+	// groups is the names of all groups added with withGroup.
+	groups []string
+	// nOpenGroups is the number of groups opened within preformatted.
+	nOpenGroups int
+}
+
+func newEncoder(w io.Writer, conf *config, tracePrefix string) *encoder {
+	return &encoder{
+		w:                  w,
+		mu:                 &sync.Mutex{},
+		level:              conf.options.Level,
+		addSource:          conf.options.AddSource,
+		trimSourcePath:     conf.trimSourcePath,
+		sourceRoots:        conf.sourceRoots,
+		trimSourceFunction: conf.trimSourceFunction,
+		replaceAttr:        conf.options.ReplaceAttr,
+		redactProto:        conf.redactProto,
+		insertID:           conf.insertID,
+		tracePrefix:        tracePrefix,
+		// Like slog.JSONHandler, ReplaceAttr receives a non-nil slice for
+		// non-builtin attributes.
+		groups: []string{},
+	}
+}
+
+func (e *encoder) enabled(l slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if e.level != nil {
+		minLevel = e.level.Level()
+	}
+	return l >= minLevel
+}
+
+func (e *encoder) handle(r slog.Record, sctx trace.SpanContext) error {
+	bufp := buffers.Get().(*[]byte) //nolint:forcetypeassert // pool type well defined
+	buf := (*bufp)[:0]
+	defer func() {
+		if cap(buf) > maxBufferSize {
+			return
+		}
+		*bufp = buf[:0]
+		buffers.Put(bufp)
+	}()
+
+	buf = append(buf, '{')
+	if !r.Time.IsZero() {
+		buf = appendKey(buf, "timestamp")
+		buf = appendJSONTime(buf, r.Time)
+	}
+	buf = appendKey(buf, "severity")
+	buf = appendJSONString(buf, severity(r.Level))
+	if e.addSource && r.PC != 0 {
+		buf = e.appendSource(buf, r.PC)
+	}
+	buf = appendKey(buf, "message")
+	buf = appendJSONString(buf, r.Message)
+
+	buf = append(buf, e.preformatted...)
+	openGroups := e.nOpenGroups
+	if r.NumAttrs() > 0 {
+		mark := len(buf)
+		for _, g := range e.groups[e.nOpenGroups:] {
+			buf = appendKey(buf, g)
+			buf = append(buf, '{')
+		}
+		start := len(buf)
+		r.Attrs(func(a slog.Attr) bool {
+			buf = e.appendAttr(buf, e.groups, a)
+			return true
+		})
+		if len(buf) == start {
+			buf = buf[:mark]
+		} else {
+			openGroups = len(e.groups)
+		}
+	}
+	for range openGroups {
+		buf = append(buf, '}')
+	}
+
+	// We don't check existing attributes since it is extremely unlikely
+	// a user would set them manually.
+	if sctx.IsValid() {
+		buf = appendTrace(buf, e.tracePrefix, sctx)
+	}
+
+	switch e.insertID {
+	case insertIDSequential:
+		buf = appendKey(buf, "logging.googleapis.com/insertId")
+		buf = appendSequentialInsertID(buf)
+	case insertIDDeterministic:
+		entry := buf
+		buf = appendKey(buf, "logging.googleapis.com/insertId")
+		buf = appendDeterministicInsertID(buf, entry)
+	case insertIDNone:
+	}
+
+	buf = append(buf, '}', '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.w.Write(buf)
+	return err //nolint:wrapcheck // writer errors returned as-is
+}
+
+func (e *encoder) withAttrs(attrs []slog.Attr) *encoder {
+	if len(attrs) == 0 {
+		return e
+	}
+
+	buf := slices.Clone(e.preformatted)
+	for _, g := range e.groups[e.nOpenGroups:] {
+		buf = appendKey(buf, g)
+		buf = append(buf, '{')
+	}
+	start := len(buf)
+	for _, a := range attrs {
+		buf = e.appendAttr(buf, e.groups, a)
+	}
+	if len(buf) == start {
+		// Only empty attributes, so don't open any groups.
+		return e
+	}
+
+	res := *e
+	res.preformatted = buf
+	res.nOpenGroups = len(e.groups)
+	return &res
+}
+
+func (e *encoder) withGroup(name string) *encoder {
+	if name == "" {
+		return e
+	}
+
+	res := *e
+	res.groups = append(slices.Clip(e.groups), name)
+	return &res
+}
+
+func (e *encoder) appendAttr(buf []byte, groups []string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if e.replaceAttr != nil && a.Value.Kind() != slog.KindGroup {
+		a = e.replaceAttr(groups, a)
+		a.Value = a.Value.Resolve()
+	}
+	if a.Equal(slog.Attr{}) {
+		return buf
+	}
+
+	if a.Value.Kind() != slog.KindGroup {
+		buf = appendKey(buf, a.Key)
+		if a.Value.Kind() == slog.KindAny {
+			if m, ok := a.Value.Any().(proto.Message); ok {
+				return appendProto(buf, m, e.redactProto)
+			}
+		}
+		return appendValue(buf, a.Value)
+	}
+
+	attrs := a.Value.Group()
+	if len(attrs) == 0 {
+		return buf
+	}
+	if a.Key == "" {
+		// Inline group.
+		for _, ga := range attrs {
+			buf = e.appendAttr(buf, groups, ga)
+		}
+		return buf
+	}
+
+	mark := len(buf)
+	buf = appendKey(buf, a.Key)
+	buf = append(buf, '{')
+	start := len(buf)
+	if e.replaceAttr != nil {
+		groups = append(slices.Clip(groups), a.Key)
+	}
+	for _, ga := range attrs {
+		buf = e.appendAttr(buf, groups, ga)
+	}
+	if len(buf) == start {
+		return buf[:mark]
+	}
+	return append(buf, '}')
+}
+
+func appendValue(buf []byte, v slog.Value) []byte {
+	switch v.Kind() {
+	case slog.KindString:
+		return appendJSONString(buf, v.String())
+	case slog.KindInt64:
+		return strconv.AppendInt(buf, v.Int64(), 10)
+	case slog.KindUint64:
+		return strconv.AppendUint(buf, v.Uint64(), 10)
+	case slog.KindFloat64:
+		return appendJSONFloat(buf, v.Float64())
+	case slog.KindBool:
+		return strconv.AppendBool(buf, v.Bool())
+	case slog.KindDuration:
+		// Do what json.Marshal does.
+		return strconv.AppendInt(buf, int64(v.Duration()), 10)
+	case slog.KindTime:
+		return appendJSONTime(buf, v.Time())
+	case slog.KindAny, slog.KindGroup, slog.KindLogValuer:
+		a := v.Any()
+		_, jm := a.(json.Marshaler)
+		if err, ok := a.(error); ok && !jm {
+			return appendJSONString(buf, err.Error())
+		}
+		return appendJSONMarshal(buf, a)
+	default:
+		panic(fmt.Sprintf("bad kind: %s", v.Kind()))
+	}
+}
+
+func (e *encoder) appendSource(buf []byte, pc uintptr) []byte {
+	f := sourceFrame(pc)
+	file := f.File
+	if e.trimSourcePath {
+		file = trimSourcePath(e.sourceRoots, f.Function, file)
+	}
+	function := f.Function
+	if e.trimSourceFunction {
+		function = trimSourceFunction(function)
+	}
+
+	buf = appendKey(buf, "logging.googleapis.com/sourceLocation")
+	buf = append(buf, '{')
+	buf = appendKey(buf, "file")
+	buf = appendJSONString(buf, file)
+	buf = appendKey(buf, "line")
+	buf = append(buf, '"')
+	buf = strconv.AppendInt(buf, int64(f.Line), 10)
+	buf = append(buf, '"')
+	buf = appendKey(buf, "function")
+	buf = appendJSONString(buf, function)
+	return append(buf, '}')
+}
+
+func appendTrace(buf []byte, tracePrefix string, sctx trace.SpanContext) []byte {
+	traceID := sctx.TraceID()
+	spanID := sctx.SpanID()
+
+	buf = appendKey(buf, "logging.googleapis.com/trace")
+	buf = append(buf, '"')
+	buf = appendEscapedJSONString(buf, tracePrefix)
+	buf = hex.AppendEncode(buf, traceID[:])
+	buf = append(buf, '"')
+	buf = appendKey(buf, "logging.googleapis.com/spanId")
+	buf = append(buf, '"')
+	buf = hex.AppendEncode(buf, spanID[:])
+	buf = append(buf, '"')
+	buf = appendKey(buf, "logging.googleapis.com/trace_sampled")
+	return strconv.AppendBool(buf, sctx.IsSampled())
+}
+
+// severity returns the GCP LogSeverity name for a level. Levels between the
+// ones defined by slog are rounded down, and levels above slog.LevelError map
+// to the higher GCP severities in steps of 4.
+func severity(l slog.Level) string {
+	switch {
+	case l < slog.LevelInfo:
+		return "DEBUG"
+	case l < slog.LevelWarn:
+		return "INFO"
+	case l < slog.LevelError:
+		return "WARNING"
+	case l < slog.LevelError+4:
+		return "ERROR"
+	case l < slog.LevelError+8:
+		return "CRITICAL"
+	case l < slog.LevelError+12:
+		return "ALERT"
+	default:
+		return "EMERGENCY"
+	}
+}
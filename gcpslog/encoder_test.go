@@ -0,0 +1,266 @@
+package gcpslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewHandlerAttrs(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("01020304010203040102030401020304")
+	spanID, _ := trace.SpanIDFromHex("0102030401020304")
+	spanCtx := trace.ContextWithSpanContext(t.Context(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+
+	tests := []struct {
+		name string
+		log  func(l *slog.Logger)
+
+		logged map[string]any
+	}{
+		{
+			name: "kinds",
+			log: func(l *slog.Logger) {
+				l.Info("kinds",
+					slog.String("string", "a\"b\n<c> "),
+					slog.Int("int", -1),
+					slog.Uint64("uint", 2),
+					slog.Float64("float", 1.5),
+					slog.Float64("small", 1e-7),
+					slog.Bool("bool", true),
+					slog.Duration("duration", time.Second),
+					slog.Time("time", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+					slog.Any("error", errors.New("failure")),
+					slog.Any("map", map[string]int{"a": 1}),
+					slog.Any("nil", nil),
+				)
+			},
+
+			logged: map[string]any{
+				"message":  "kinds",
+				"severity": "INFO",
+				"string":   "a\"b\n<c> ",
+				"int":      -1.0,
+				"uint":     2.0,
+				"float":    1.5,
+				"small":    1e-7,
+				"bool":     true,
+				"duration": float64(time.Second),
+				"time":     "2024-01-02T03:04:05Z",
+				"error":    "failure",
+				"map":      map[string]any{"a": 1.0},
+				"nil":      nil,
+			},
+		},
+		{
+			name: "warn",
+			log: func(l *slog.Logger) {
+				l.Warn("careful")
+			},
+
+			logged: map[string]any{
+				"message":  "careful",
+				"severity": "WARNING",
+			},
+		},
+		{
+			name: "groups",
+			log: func(l *slog.Logger) {
+				l.With("a", 1).
+					WithGroup("empty").
+					WithGroup("g").
+					With("b", 2).
+					WithGroup("h").
+					InfoContext(spanCtx, "grouped", "c", 3, slog.Group("i", "d", 4), slog.Group("", "e", 5), slog.Group("j"))
+			},
+
+			logged: map[string]any{
+				"message":  "grouped",
+				"severity": "INFO",
+				"a":        1.0,
+				"empty": map[string]any{
+					"g": map[string]any{
+						"b": 2.0,
+						"h": map[string]any{
+							"c": 3.0,
+							"i": map[string]any{"d": 4.0},
+							"e": 5.0,
+						},
+					},
+				},
+				"logging.googleapis.com/trace":         "projects/unknown/traces/01020304010203040102030401020304",
+				"logging.googleapis.com/spanId":        "0102030401020304",
+				"logging.googleapis.com/trace_sampled": false,
+			},
+		},
+		{
+			name: "empty group omitted",
+			log: func(l *slog.Logger) {
+				l.With("a", 1).WithGroup("g").Info("no attrs")
+			},
+
+			logged: map[string]any{
+				"message":  "no attrs",
+				"severity": "INFO",
+				"a":        1.0,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+
+			l := slog.New(NewHandler(&out))
+			tc.log(l)
+
+			var rec map[string]any
+			require.NoError(t, json.Unmarshal(out.Bytes(), &rec))
+
+			require.NotEmpty(t, rec["timestamp"])
+			delete(rec, "timestamp")
+
+			require.Equal(t, tc.logged, rec)
+		})
+	}
+}
+
+func TestNewHandlerAllocs(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("01020304010203040102030401020304")
+	spanID, _ := trace.SpanIDFromHex("0102030401020304")
+	ctx := trace.ContextWithSpanContext(t.Context(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	l := slog.New(NewHandler(io.Discard, InsertID())).With("service", "bear").WithGroup("request")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		l.LogAttrs(ctx, slog.LevelInfo, "normal log",
+			slog.String("animal", "bear"),
+			slog.Int("count", 10),
+			slog.Duration("elapsed", time.Second),
+		)
+	})
+	require.Zero(t, allocs)
+}
+
+// newJSONHandler returns a handler equivalent to the previous implementation
+// of NewHandler, which adapted slog.JSONHandler, for benchmark comparison.
+func newJSONHandler(w io.Writer) slog.Handler {
+	return jsonOtelHandler{
+		delegate: slog.NewJSONHandler(w, &slog.HandlerOptions{
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if groups == nil {
+					switch a.Key {
+					case slog.LevelKey:
+						return slog.Attr{Key: "severity", Value: a.Value}
+					case slog.MessageKey:
+						return slog.Attr{Key: "message", Value: a.Value}
+					case slog.TimeKey:
+						return slog.Attr{Key: "timestamp", Value: a.Value}
+					}
+				}
+				return a
+			},
+		}),
+	}
+}
+
+type jsonOtelHandler struct {
+	delegate slog.Handler
+}
+
+func (h jsonOtelHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.delegate.Enabled(ctx, l)
+}
+
+func (h jsonOtelHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sctx := trace.SpanContextFromContext(ctx); sctx.IsValid() {
+		r.AddAttrs(
+			slog.String("logging.googleapis.com/trace", "projects/unknown/traces/"+sctx.TraceID().String()),
+			slog.String("logging.googleapis.com/spanId", sctx.SpanID().String()),
+			slog.Bool("logging.googleapis.com/trace_sampled", sctx.IsSampled()),
+		)
+	}
+	return h.delegate.Handle(ctx, r)
+}
+
+func (h jsonOtelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return jsonOtelHandler{delegate: h.delegate.WithAttrs(attrs)}
+}
+
+func (h jsonOtelHandler) WithGroup(name string) slog.Handler {
+	return jsonOtelHandler{delegate: h.delegate.WithGroup(name)}
+}
+
+func BenchmarkHandler(b *testing.B) {
+	traceID, _ := trace.TraceIDFromHex("01020304010203040102030401020304")
+	spanID, _ := trace.SpanIDFromHex("0102030401020304")
+	spanCtx := trace.ContextWithSpanContext(b.Context(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	handlers := []struct {
+		name    string
+		handler slog.Handler
+	}{
+		{name: "gcpslog", handler: NewHandler(io.Discard)},
+		{name: "jsonhandler", handler: newJSONHandler(io.Discard)},
+	}
+
+	for _, h := range handlers {
+		b.Run(h.name, func(b *testing.B) {
+			b.Run("message", func(b *testing.B) {
+				l := slog.New(h.handler)
+				b.ReportAllocs()
+				for b.Loop() {
+					l.LogAttrs(b.Context(), slog.LevelInfo, "normal log")
+				}
+			})
+			b.Run("attrs", func(b *testing.B) {
+				l := slog.New(h.handler)
+				b.ReportAllocs()
+				for b.Loop() {
+					l.LogAttrs(b.Context(), slog.LevelInfo, "normal log",
+						slog.String("animal", "bear"),
+						slog.Int("count", 10),
+						slog.Duration("elapsed", time.Second),
+						slog.Bool("hungry", true),
+					)
+				}
+			})
+			b.Run("span", func(b *testing.B) {
+				l := slog.New(h.handler)
+				b.ReportAllocs()
+				for b.Loop() {
+					l.LogAttrs(spanCtx, slog.LevelInfo, "normal log",
+						slog.String("animal", "bear"),
+					)
+				}
+			})
+			b.Run("with attrs", func(b *testing.B) {
+				l := slog.New(h.handler).With("service", "bear").WithGroup("request")
+				b.ReportAllocs()
+				for b.Loop() {
+					l.LogAttrs(spanCtx, slog.LevelInfo, "normal log",
+						slog.String("animal", "bear"),
+					)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package gcpslog
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+)
+
+type insertIDMode int
+
+const (
+	insertIDNone insertIDMode = iota
+	insertIDSequential
+	insertIDDeterministic
+)
+
+var (
+	// insertIDPrefix is a random identifier for this process, making IDs from
+	// different instances unique.
+	insertIDPrefix = sync.OnceValue(func() string {
+		var b [8]byte
+		_, _ = rand.Read(b[:])
+		return hex.EncodeToString(b[:])
+	})
+	insertIDCounter atomic.Uint64
+)
+
+// appendSequentialInsertID appends an ID made of the process prefix and a
+// counter. The counter is zero-padded so IDs sort in the order they were
+// generated, which Cloud Logging uses to order entries with the same
+// timestamp.
+func appendSequentialInsertID(buf []byte) []byte {
+	n := insertIDCounter.Add(1)
+
+	var digits [16]byte
+	for i := len(digits) - 1; i >= 0; i-- {
+		digits[i] = hexDigits[n&0xF]
+		n >>= 4
+	}
+
+	buf = append(buf, '"')
+	buf = append(buf, insertIDPrefix()...)
+	buf = append(buf, '-')
+	buf = append(buf, digits[:]...)
+	return append(buf, '"')
+}
+
+// appendDeterministicInsertID appends an ID derived from the hash of the
+// already encoded entry, so the same record always has the same ID.
+func appendDeterministicInsertID(buf []byte, entry []byte) []byte {
+	sum := sha256.Sum256(entry)
+	buf = append(buf, '"')
+	buf = hex.AppendEncode(buf, sum[:16])
+	return append(buf, '"')
+}
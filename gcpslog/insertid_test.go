@@ -0,0 +1,69 @@
+package gcpslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHandlerInsertID(t *testing.T) {
+	type insertIDRecord struct {
+		Message  string `json:"message"`
+		InsertID string `json:"logging.googleapis.com/insertId"`
+	}
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("none", func(t *testing.T) {
+		var out bytes.Buffer
+		slog.New(NewHandler(&out)).Info("no id")
+
+		var rec insertIDRecord
+		require.NoError(t, json.Unmarshal(out.Bytes(), &rec))
+		require.Empty(t, rec.InsertID)
+	})
+
+	t.Run("sequential", func(t *testing.T) {
+		var out bytes.Buffer
+		l := slog.New(NewHandler(&out, InsertID()))
+		l.Info("first")
+		l.Info("first")
+
+		lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+		require.Len(t, lines, 2)
+		var first, second insertIDRecord
+		require.NoError(t, json.Unmarshal(lines[0], &first))
+		require.NoError(t, json.Unmarshal(lines[1], &second))
+
+		require.Regexp(t, `^[0-9a-f]{16}-[0-9a-f]{16}$`, first.InsertID)
+		require.Regexp(t, `^[0-9a-f]{16}-[0-9a-f]{16}$`, second.InsertID)
+		require.Equal(t, first.InsertID[:17], second.InsertID[:17])
+		require.Less(t, first.InsertID, second.InsertID)
+	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		var out bytes.Buffer
+		h := NewHandler(&out, DeterministicInsertID())
+
+		for _, message := range []string{"first", "first", "second"} {
+			r := slog.NewRecord(now, slog.LevelInfo, message, 0)
+			r.AddAttrs(slog.String("animal", "bear"))
+			require.NoError(t, h.Handle(t.Context(), r))
+		}
+
+		lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+		require.Len(t, lines, 3)
+		recs := make([]insertIDRecord, len(lines))
+		for i, line := range lines {
+			require.NoError(t, json.Unmarshal(line, &recs[i]))
+			require.Regexp(t, `^[0-9a-f]{32}$`, recs[i].InsertID)
+		}
+
+		require.Equal(t, recs[0].InsertID, recs[1].InsertID)
+		require.NotEqual(t, recs[0].InsertID, recs[2].InsertID)
+	})
+}
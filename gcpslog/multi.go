@@ -0,0 +1,116 @@
+package gcpslog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"golang.org/x/oauth2/google"
+)
+
+// NewMultiHandler returns a new [slog.Handler] that writes records to each of
+// the sinks enabled for their level. This can be used to, for example, write
+// info logs in GCP's format to stdout while writing debug logs to a local
+// file during an investigation. The OpenTelemetry span context of a record is
+// only resolved once and shared by all sinks.
+func NewMultiHandler(sinks ...Sink) slog.Handler {
+	creds, err := google.FindDefaultCredentials(context.Background())
+	tracePrefix := "projects/unknown/traces/"
+	if err == nil && creds.ProjectID != "" {
+		tracePrefix = fmt.Sprintf("projects/%s/traces/", creds.ProjectID)
+	}
+
+	ss := make([]sink, len(sinks))
+	for i, s := range sinks {
+		ss[i] = s.build(tracePrefix)
+	}
+
+	return otelLogHandler{
+		sinks:       ss,
+		tracePrefix: tracePrefix,
+	}
+}
+
+// Sink is a destination for records of a handler created by NewMultiHandler,
+// with its own writer and options such as the level and format.
+type Sink struct {
+	w    io.Writer
+	conf config
+}
+
+// NewSink returns a Sink writing to w, configured with opts. The options are
+// the same as for NewHandler.
+func NewSink(w io.Writer, opts ...Option) Sink {
+	var conf config
+	for _, o := range opts {
+		o.apply(&conf)
+	}
+	return Sink{w: w, conf: conf}
+}
+
+func (s Sink) build(tracePrefix string) sink {
+	switch s.conf.format {
+	case FormatJSON:
+		return sink{handler: slog.NewJSONHandler(s.w, &s.conf.options)}
+	case FormatText:
+		return sink{handler: slog.NewTextHandler(s.w, &s.conf.options)}
+	case FormatGCP:
+		// Default, handled below.
+	}
+	return sink{enc: newEncoder(s.w, &s.conf, tracePrefix)}
+}
+
+// sink is a built Sink, either formatting for GCP with an encoder or
+// delegating to one of slog's handlers.
+type sink struct {
+	enc     *encoder
+	handler slog.Handler
+}
+
+func (s sink) enabled(ctx context.Context, l slog.Level) bool {
+	if s.enc != nil {
+		return s.enc.enabled(l)
+	}
+	return s.handler.Enabled(ctx, l)
+}
+
+func (s sink) withAttrs(attrs []slog.Attr) sink {
+	if s.enc != nil {
+		return sink{enc: s.enc.withAttrs(attrs)}
+	}
+	return sink{handler: s.handler.WithAttrs(attrs)}
+}
+
+func (s sink) withGroup(name string) sink {
+	if s.enc != nil {
+		return sink{enc: s.enc.withGroup(name)}
+	}
+	return sink{handler: s.handler.WithGroup(name)}
+}
+
+// Format is the output format of a Sink.
+type Format int
+
+const (
+	// FormatGCP outputs JSON with keys following GCP's format. This is the
+	// default.
+	FormatGCP Format = iota
+	// FormatJSON outputs JSON using [slog.JSONHandler].
+	FormatJSON
+	// FormatText outputs key=value pairs using [slog.TextHandler], which can
+	// be easier to read in a local file.
+	FormatText
+)
+
+// OutputFormat returns an Option to set the format of the output. Options
+// other than Level, AddSource and ReplaceAttr only apply to [FormatGCP].
+func OutputFormat(f Format) Option {
+	return formatOption(f)
+}
+
+type formatOption Format
+
+func (o formatOption) apply(conf *config) {
+	conf.format = Format(o)
+}
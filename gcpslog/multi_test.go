@@ -0,0 +1,67 @@
+package gcpslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewMultiHandler(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("01020304010203040102030401020304")
+	spanID, _ := trace.SpanIDFromHex("0102030401020304")
+	ctx := trace.ContextWithSpanContext(t.Context(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	var gcpOut, jsonOut, textOut bytes.Buffer
+	l := slog.New(NewMultiHandler(
+		NewSink(&gcpOut),
+		NewSink(&jsonOut, Level(slog.LevelDebug), OutputFormat(FormatJSON)),
+		NewSink(&textOut, Level(slog.LevelDebug), OutputFormat(FormatText), ReplaceAttr(func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		})),
+	)).With("animal", "bear")
+
+	require.True(t, l.Enabled(ctx, slog.LevelDebug))
+
+	l.DebugContext(ctx, "debug log")
+	l.InfoContext(ctx, "info log")
+
+	var gcpRec logRecord
+	require.NoError(t, json.Unmarshal(gcpOut.Bytes(), &gcpRec))
+	gcpRec.Timestamp = ""
+	require.Equal(t, logRecord{
+		Message:  "info log",
+		Severity: "INFO",
+		TraceID:  "projects/unknown/traces/01020304010203040102030401020304",
+		SpanID:   "0102030401020304",
+		Sampled:  true,
+		Animal:   "bear",
+	}, gcpRec)
+
+	jsonLines := bytes.Split(bytes.TrimSpace(jsonOut.Bytes()), []byte("\n"))
+	require.Len(t, jsonLines, 2)
+	var jsonRec map[string]any
+	require.NoError(t, json.Unmarshal(jsonLines[0], &jsonRec))
+	require.Equal(t, "debug log", jsonRec["msg"])
+	require.Equal(t, "DEBUG", jsonRec["level"])
+	require.Equal(t, "bear", jsonRec["animal"])
+	require.Equal(t, "projects/unknown/traces/01020304010203040102030401020304", jsonRec["logging.googleapis.com/trace"])
+
+	require.Equal(t, "level=DEBUG msg=\"debug log\" animal=bear "+
+		"logging.googleapis.com/trace=projects/unknown/traces/01020304010203040102030401020304 "+
+		"logging.googleapis.com/spanId=0102030401020304 logging.googleapis.com/trace_sampled=true\n"+
+		"level=INFO msg=\"info log\" animal=bear "+
+		"logging.googleapis.com/trace=projects/unknown/traces/01020304010203040102030401020304 "+
+		"logging.googleapis.com/spanId=0102030401020304 logging.googleapis.com/trace_sampled=true\n",
+		textOut.String())
+}
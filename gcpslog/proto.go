@@ -0,0 +1,57 @@
+package gcpslog
+
+import (
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func appendProto(buf []byte, m proto.Message, redact func(protoreflect.FieldDescriptor) bool) []byte {
+	if redact != nil {
+		m = proto.Clone(m)
+		redactMessage(m.ProtoReflect(), redact)
+	}
+
+	b, err := protojson.MarshalOptions{}.MarshalAppend(buf, m)
+	if err != nil {
+		return appendJSONString(buf, "!ERROR:"+err.Error())
+	}
+	return b
+}
+
+func redactMessage(m protoreflect.Message, redact func(protoreflect.FieldDescriptor) bool) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if redact(fd) {
+			m.Clear(fd)
+			return true
+		}
+
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+			v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+				redactMessage(mv.Message(), redact)
+				return true
+			})
+		case fd.IsList():
+			if fd.Message() == nil {
+				return true
+			}
+			l := v.List()
+			for i := range l.Len() {
+				redactMessage(l.Get(i).Message(), redact)
+			}
+		case fd.Message() != nil:
+			redactMessage(v.Message(), redact)
+		}
+		return true
+	})
+}
+
+func isDebugRedact(fd protoreflect.FieldDescriptor) bool {
+	opts, ok := fd.Options().(*descriptorpb.FieldOptions)
+	return ok && opts.GetDebugRedact()
+}
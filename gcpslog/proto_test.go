@@ -0,0 +1,161 @@
+package gcpslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type credentialsValuer struct {
+	creds proto.Message
+}
+
+func (v credentialsValuer) LogValue() slog.Value {
+	return slog.AnyValue(v.creds)
+}
+
+func TestNewHandlerProto(t *testing.T) {
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("gcpslog_test.proto"),
+		Package: proto.String("gcpslog.test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Credentials"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{
+						Name:     proto.String("user"),
+						JsonName: proto.String("user"),
+						Number:   proto.Int32(1),
+						Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+						Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+					},
+					{
+						Name:     proto.String("password"),
+						JsonName: proto.String("password"),
+						Number:   proto.Int32(2),
+						Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+						Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+						Options:  &descriptorpb.FieldOptions{DebugRedact: proto.Bool(true)},
+					},
+					{
+						Name:     proto.String("delegates"),
+						JsonName: proto.String("delegates"),
+						Number:   proto.Int32(3),
+						Label:    descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+						Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+						TypeName: proto.String(".gcpslog.test.Credentials"),
+					},
+				},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	md := fd.Messages().Get(0)
+	newCreds := func(user, password string) *dynamicpb.Message {
+		m := dynamicpb.NewMessage(md)
+		m.Set(md.Fields().ByName("user"), protoreflect.ValueOfString(user))
+		m.Set(md.Fields().ByName("password"), protoreflect.ValueOfString(password))
+		return m
+	}
+	creds := newCreds("bear", "honey")
+	delegates := creds.Mutable(md.Fields().ByName("delegates")).List()
+	delegates.Append(protoreflect.ValueOfMessage(newCreds("cub", "berries")))
+
+	payload, err := structpb.NewStruct(map[string]any{"animal": "bear", "count": 2})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		attr slog.Attr
+		opts []Option
+
+		logged any
+	}{
+		{
+			name: "struct",
+			attr: slog.Any("payload", payload),
+
+			logged: map[string]any{"animal": "bear", "count": 2.0},
+		},
+		{
+			name: "unredacted",
+			attr: slog.Any("payload", creds),
+
+			logged: map[string]any{
+				"user":     "bear",
+				"password": "honey",
+				"delegates": []any{
+					map[string]any{"user": "cub", "password": "berries"},
+				},
+			},
+		},
+		{
+			name: "debug redact",
+			attr: slog.Any("payload", creds),
+			opts: []Option{RedactProtoFields(nil)},
+
+			logged: map[string]any{
+				"user": "bear",
+				"delegates": []any{
+					map[string]any{"user": "cub"},
+				},
+			},
+		},
+		{
+			name: "custom redact",
+			attr: slog.Any("payload", creds),
+			opts: []Option{RedactProtoFields(func(fd protoreflect.FieldDescriptor) bool {
+				return fd.Name() == "delegates"
+			})},
+
+			logged: map[string]any{
+				"user":     "bear",
+				"password": "honey",
+			},
+		},
+		{
+			name: "log valuer",
+			attr: slog.Any("payload", credentialsValuer{creds: newCreds("bear", "honey")}),
+			opts: []Option{RedactProtoFields(nil)},
+
+			logged: map[string]any{"user": "bear"},
+		},
+		{
+			name: "group",
+			attr: slog.Group("payload", slog.Any("password", wrapperspb.String("honey"))),
+
+			logged: map[string]any{"password": "honey"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+
+			l := slog.New(NewHandler(&out, tc.opts...))
+			l.LogAttrs(t.Context(), slog.LevelInfo, "proto", tc.attr)
+
+			var rec map[string]any
+			require.NoError(t, json.Unmarshal(out.Bytes(), &rec))
+
+			require.Equal(t, tc.logged, rec["payload"])
+		})
+	}
+
+	// The original message is not modified by redaction.
+	require.Equal(t, "honey", creds.Get(md.Fields().ByName("password")).String())
+}
+
+// logHelper is a helper function marked with Helper.
@@ -2,68 +2,32 @@ package gcpslog
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"io"
 	"log/slog"
-	"strconv"
 
 	"go.opentelemetry.io/otel/trace"
-	"golang.org/x/oauth2/google"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // NewHandler returns a new [slog.Handler], outputting in JSON with keys
 // formatted to follow GCP's format for proper rendering in the console.
 // If an OpenTelemetry span is active, its context IDs will also be recorded
 // with GCP's format, allowing traces and logs to be linked in the console.
+//
+// Records are encoded directly into pooled buffers, so logging does not
+// allocate for attributes of the basic kinds. Levels are written as the
+// closest GCP severity, for example [slog.LevelWarn] is written as WARNING.
+// Attributes with a [proto.Message] value, including ones returned by a
+// [slog.LogValuer], are rendered using the protobuf JSON mapping so they
+// appear as nested JSON in the log payload. Attributes added to the context
+// with [ContextWithAttrs] are included in each record.
 func NewHandler(w io.Writer, opts ...Option) slog.Handler {
-	var conf config
-	for _, o := range opts {
-		o.apply(&conf)
-	}
-	userRA := conf.options.ReplaceAttr
-	conf.options.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
-		if groups == nil {
-			switch a.Key {
-			case slog.LevelKey:
-				return slog.Attr{Key: "severity", Value: a.Value}
-			case slog.MessageKey:
-				return slog.Attr{Key: "message", Value: a.Value}
-			case slog.TimeKey:
-				return slog.Attr{Key: "timestamp", Value: a.Value}
-			case slog.SourceKey:
-				if val, ok := a.Value.Any().(*slog.Source); ok {
-					return slog.Group("logging.googleapis.com/sourceLocation",
-						slog.String("file", val.File),
-						slog.String("line", strconv.Itoa(val.Line)),
-						slog.String("function", val.Function),
-					)
-				}
-			}
-		}
-
-		if userRA != nil {
-			return userRA(groups, a)
-		}
-
-		return a
-	}
-
-	delegate := slog.NewJSONHandler(w, &conf.options)
-
-	creds, err := google.FindDefaultCredentials(context.Background())
-	tracePrefix := "projects/unknown/traces/"
-	if err == nil && creds.ProjectID != "" {
-		tracePrefix = fmt.Sprintf("projects/%s/traces/", creds.ProjectID)
-	}
-
-	return otelLogHandler{
-		delegate:    delegate,
-		tracePrefix: tracePrefix,
-	}
+	return NewMultiHandler(NewSink(w, opts...))
 }
 
 type otelLogHandler struct {
-	delegate    slog.Handler
+	sinks       []sink
 	tracePrefix string
 }
 
@@ -71,43 +35,99 @@ var _ slog.Handler = otelLogHandler{}
 
 // Enabled implements slog.Handler.
 func (h otelLogHandler) Enabled(ctx context.Context, l slog.Level) bool {
-	return h.delegate.Enabled(ctx, l)
+	for _, s := range h.sinks {
+		if s.enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
 }
 
 // Handle implements slog.Handler.
 func (h otelLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	sctx := trace.SpanContextFromContext(ctx)
+
+	if attrs := attrsFromContext(ctx); len(attrs) > 0 {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+
+	// Sinks using slog's handlers need the trace as attributes, which we only
+	// add once for all of them.
+	var traced *slog.Record
+
+	var errs []error
+	for _, s := range h.sinks {
+		if !s.enabled(ctx, r.Level) {
+			continue
+		}
+
+		var err error
+		if s.enc != nil {
+			err = s.enc.handle(r, sctx)
+		} else {
+			if traced == nil {
+				traced = h.addTrace(r, sctx)
+			}
+			err = s.handler.Handle(ctx, *traced)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (h otelLogHandler) addTrace(r slog.Record, sctx trace.SpanContext) *slog.Record {
+	r = r.Clone()
 	// We don't check existing attributes since it is extremely unlikely
 	// a user would set them manually.
-	if sctx := trace.SpanContextFromContext(ctx); sctx.IsValid() {
+	if sctx.IsValid() {
 		r.AddAttrs(
 			slog.String("logging.googleapis.com/trace", h.tracePrefix+sctx.TraceID().String()),
 			slog.String("logging.googleapis.com/spanId", sctx.SpanID().String()),
 			slog.Bool("logging.googleapis.com/trace_sampled", sctx.IsSampled()),
 		)
 	}
-
-	return h.delegate.Handle(ctx, r) //nolint:wrapcheck // just middleware
+	return &r
 }
 
 // WithAttrs implements slog.Handler.
 func (h otelLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	sinks := make([]sink, len(h.sinks))
+	for i, s := range h.sinks {
+		sinks[i] = s.withAttrs(attrs)
+	}
 	return otelLogHandler{
-		delegate: h.delegate.WithAttrs(attrs),
+		sinks:       sinks,
+		tracePrefix: h.tracePrefix,
 	}
 }
 
 // WithGroup implements slog.Handler.
 func (h otelLogHandler) WithGroup(name string) slog.Handler {
+	sinks := make([]sink, len(h.sinks))
+	for i, s := range h.sinks {
+		sinks[i] = s.withGroup(name)
+	}
 	return otelLogHandler{
-		delegate: h.delegate.WithGroup(name),
+		sinks:       sinks,
+		tracePrefix: h.tracePrefix,
 	}
 }
 
 type config struct {
-	options slog.HandlerOptions
+	options            slog.HandlerOptions
+	format             Format
+	trimSourcePath     bool
+	sourceRoots        []string
+	trimSourceFunction bool
+	redactProto        func(protoreflect.FieldDescriptor) bool
+	insertID           insertIDMode
 }
 
-// Option is a configuration option for NewHandler.
+// Option is a configuration option for NewHandler and NewSink.
 type Option interface {
 	apply(conf *config)
 }
@@ -140,6 +160,38 @@ func (o addSourceOption) apply(conf *config) {
 	conf.options.AddSource = true
 }
 
+// TrimSourcePath returns an Option to record source file paths relative to
+// their module rather than the absolute path on the build machine. Paths are
+// made relative to the first of roots that contains them, or otherwise, to
+// the module cache for dependencies or to the root of the main module. Only
+// has an effect with [AddSource].
+func TrimSourcePath(roots ...string) Option {
+	return trimSourcePathOption{roots: roots}
+}
+
+type trimSourcePathOption struct {
+	roots []string
+}
+
+func (o trimSourcePathOption) apply(conf *config) {
+	conf.trimSourcePath = true
+	conf.sourceRoots = o.roots
+}
+
+// TrimSourceFunction returns an Option to record source function names
+// without the import path of their package, for example gcpslog.NewHandler
+// instead of github.com/curioswitch/go-usegcp/gcpslog.NewHandler. Only has an
+// effect with [AddSource].
+func TrimSourceFunction() Option {
+	return trimSourceFunctionOption{}
+}
+
+type trimSourceFunctionOption struct{}
+
+func (o trimSourceFunctionOption) apply(conf *config) {
+	conf.trimSourceFunction = true
+}
+
 // ReplaceAttr returns an Option to replace the value of an attribute.
 // ReplaceAttr is called to rewrite each non-group attribute before it is logged.
 // Unlike the similar option in [slog.HandlerOptions], the function will not be
@@ -174,3 +226,44 @@ type replaceAttrOption func([]string, slog.Attr) slog.Attr
 func (o replaceAttrOption) apply(conf *config) {
 	conf.options.ReplaceAttr = o
 }
+
+// RedactProtoFields returns an Option to redact fields of logged proto
+// messages. Fields for which redact returns true are cleared from a copy of
+// the message before it is rendered. If redact is nil, fields annotated with
+// the standard debug_redact field option are redacted.
+func RedactProtoFields(redact func(fd protoreflect.FieldDescriptor) bool) Option {
+	if redact == nil {
+		redact = isDebugRedact
+	}
+	return redactProtoFieldsOption(redact)
+}
+
+type redactProtoFieldsOption func(protoreflect.FieldDescriptor) bool
+
+func (o redactProtoFieldsOption) apply(conf *config) {
+	conf.redactProto = o
+}
+
+// InsertID returns an Option to add a unique logging.googleapis.com/insertId
+// to each record, allowing Cloud Logging to remove duplicates when a write is
+// retried. IDs combine a random identifier for the process with a counter, so
+// they are unique across instances and increase monotonically within one.
+func InsertID() Option {
+	return insertIDOption(insertIDSequential)
+}
+
+// DeterministicInsertID returns an Option to add a
+// logging.googleapis.com/insertId to each record derived from a hash of its
+// content, including the timestamp. Replaying the same records, for example
+// when reprocessing a log file, produces the same IDs so Cloud Logging does
+// not store them twice. Note that distinct records with identical content and
+// timestamp are also treated as duplicates.
+func DeterministicInsertID() Option {
+	return insertIDOption(insertIDDeterministic)
+}
+
+type insertIDOption insertIDMode
+
+func (o insertIDOption) apply(conf *config) {
+	conf.insertID = insertIDMode(o)
+}
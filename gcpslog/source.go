@@ -0,0 +1,143 @@
+package gcpslog
+
+import (
+	"path"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	helpers    sync.Map // map[string]struct{} of function names
+	hasHelpers atomic.Bool
+)
+
+// Helper marks the calling function as a logging helper, similar to
+// [testing.T.Helper]. When computing the source location of a record, helper
+// functions are skipped so the location of the helper's caller is recorded
+// instead. This only has an effect for records handled in the goroutine that
+// logged them, which is the case when using [slog.Logger] directly.
+func Helper() {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	f, _ := runtime.CallersFrames(pcs[:]).Next()
+	if _, ok := helpers.Load(f.Function); !ok {
+		helpers.Store(f.Function, struct{}{})
+		hasHelpers.Store(true)
+	}
+}
+
+func isHelper(fn string) bool {
+	_, ok := helpers.Load(fn)
+	return ok
+}
+
+// sourceFrame returns the frame for the record's pc, skipping any frames
+// marked with Helper.
+func sourceFrame(pc uintptr) runtime.Frame {
+	f, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	if !hasHelpers.Load() || !isHelper(f.Function) {
+		return f
+	}
+
+	// The record was logged by a helper, so find its pc in the current stack
+	// to walk up to the helper's callers. The logging call will generally
+	// not be far above us.
+	var pcs [64]uintptr
+	n := runtime.Callers(2, pcs[:])
+	for i, p := range pcs[:n] {
+		if p != pc {
+			continue
+		}
+		frames := runtime.CallersFrames(pcs[i:n])
+		for {
+			cf, more := frames.Next()
+			if !isHelper(cf.Function) {
+				return cf
+			}
+			if !more {
+				break
+			}
+		}
+		break
+	}
+	return f
+}
+
+// mainPaths returns the path of the main module and the import path of the
+// main package.
+var mainPaths = sync.OnceValues(func() (string, string) {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		return bi.Main.Path, bi.Path
+	}
+	return "", ""
+})
+
+// trimSourcePath returns file relative to the first of roots that contains
+// it, falling back to the module cache or the root of the main module.
+func trimSourcePath(roots []string, function string, file string) string {
+	for _, root := range roots {
+		if rel, ok := strings.CutPrefix(file, strings.TrimSuffix(root, "/")+"/"); ok {
+			return rel
+		}
+	}
+
+	// Dependencies in the module cache, GOPATH/pkg/mod.
+	if _, rel, ok := strings.Cut(file, "/pkg/mod/"); ok {
+		return rel
+	}
+
+	mod, mainPkg := mainPaths()
+	return trimModulePath(mod, mainPkg, function, file)
+}
+
+// trimModulePath returns file relative to the root of the main module mod if
+// it is in it, using the import path of the main package mainPkg for
+// functions in package main.
+func trimModulePath(mod string, mainPkg string, function string, file string) string {
+	if mod == "" {
+		return file
+	}
+	// Built with -trimpath.
+	if rel, ok := strings.CutPrefix(file, mod+"/"); ok {
+		return rel
+	}
+	// The directory of a package in the main module always ends with its
+	// import path relative to the module.
+	pkg := functionPackage(function)
+	if pkg == "main" {
+		// Functions in the main package are named main rather than by their
+		// import path.
+		pkg = mainPkg
+	}
+	if pkg == mod {
+		return path.Base(file)
+	}
+	if relPkg, ok := strings.CutPrefix(pkg, mod+"/"); ok {
+		if strings.HasSuffix(path.Dir(file), "/"+relPkg) {
+			return relPkg + "/" + path.Base(file)
+		}
+	}
+	return file
+}
+
+// trimSourceFunction returns function without the path of its package,
+// leaving only the package name and function name.
+func trimSourceFunction(function string) string {
+	if i := strings.LastIndexByte(function, '/'); i >= 0 {
+		return function[i+1:]
+	}
+	return function
+}
+
+// functionPackage returns the import path of the package containing the
+// fully qualified function.
+func functionPackage(function string) string {
+	lastSlash := strings.LastIndexByte(function, '/')
+	if dot := strings.IndexByte(function[lastSlash+1:], '.'); dot >= 0 {
+		return function[:lastSlash+1+dot]
+	}
+	return function
+}
@@ -0,0 +1,180 @@
+package gcpslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func logHelper(l *slog.Logger) {
+	Helper()
+	l.Info("helper")
+}
+
+// logNestedHelper is a helper function calling another helper.
+func logNestedHelper(l *slog.Logger) {
+	Helper()
+	logHelper(l)
+}
+
+func TestNewHandlerSource(t *testing.T) {
+	_, thisFile, _, _ := runtime.Caller(0)
+
+	tests := []struct {
+		name string
+		opts []Option
+		log  func(l *slog.Logger) int
+
+		file     string
+		function string
+	}{
+		{
+			name: "untrimmed",
+			log: func(l *slog.Logger) int {
+				_, _, line, _ := runtime.Caller(0)
+				l.Info("untrimmed")
+				return line + 1
+			},
+
+			file:     thisFile,
+			function: "github.com/curioswitch/go-usegcp/gcpslog.TestNewHandlerSource.func1",
+		},
+		{
+			name: "trimmed",
+			opts: []Option{TrimSourcePath(), TrimSourceFunction()},
+			log: func(l *slog.Logger) int {
+				_, _, line, _ := runtime.Caller(0)
+				l.Info("trimmed")
+				return line + 1
+			},
+
+			file:     "gcpslog/source_test.go",
+			function: "gcpslog.TestNewHandlerSource.func2",
+		},
+		{
+			name: "trimmed root",
+			opts: []Option{TrimSourcePath(filepath.ToSlash(filepath.Dir(thisFile)))},
+			log: func(l *slog.Logger) int {
+				_, _, line, _ := runtime.Caller(0)
+				l.Info("trimmed root")
+				return line + 1
+			},
+
+			file:     "source_test.go",
+			function: "github.com/curioswitch/go-usegcp/gcpslog.TestNewHandlerSource.func3",
+		},
+		{
+			name: "helper",
+			opts: []Option{TrimSourcePath()},
+			log: func(l *slog.Logger) int {
+				_, _, line, _ := runtime.Caller(0)
+				logHelper(l)
+				return line + 1
+			},
+
+			file:     "gcpslog/source_test.go",
+			function: "github.com/curioswitch/go-usegcp/gcpslog.TestNewHandlerSource.func4",
+		},
+		{
+			name: "nested helper",
+			opts: []Option{TrimSourcePath()},
+			log: func(l *slog.Logger) int {
+				_, _, line, _ := runtime.Caller(0)
+				logNestedHelper(l)
+				return line + 1
+			},
+
+			file:     "gcpslog/source_test.go",
+			function: "github.com/curioswitch/go-usegcp/gcpslog.TestNewHandlerSource.func5",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+
+			l := slog.New(NewHandler(&out, append([]Option{AddSource()}, tc.opts...)...))
+			line := tc.log(l)
+
+			var rec logRecord
+			require.NoError(t, json.Unmarshal(out.Bytes(), &rec))
+
+			require.Equal(t, sourceRecord{
+				File:     tc.file,
+				Line:     strconv.Itoa(line),
+				Function: tc.function,
+			}, rec.Source)
+		})
+	}
+}
+
+func TestTrimModulePath(t *testing.T) {
+	const mod = "github.com/curioswitch/server"
+
+	tests := []struct {
+		name     string
+		mainPkg  string
+		function string
+		file     string
+
+		trimmed string
+	}{
+		{
+			name:     "module root",
+			function: "github.com/curioswitch/server.Run",
+			file:     "/home/runner/work/server/server/server.go",
+			trimmed:  "server.go",
+		},
+		{
+			name:     "package",
+			function: "github.com/curioswitch/server/internal/handler.(*Handler).ServeHTTP",
+			file:     "/home/runner/work/server/server/internal/handler/handler.go",
+			trimmed:  "internal/handler/handler.go",
+		},
+		{
+			name:     "trimpath",
+			function: "github.com/curioswitch/server/internal/handler.Serve",
+			file:     "github.com/curioswitch/server/internal/handler/handler.go",
+			trimmed:  "internal/handler/handler.go",
+		},
+		{
+			name:     "main package",
+			mainPkg:  "github.com/curioswitch/server/cmd/server",
+			function: "main.main",
+			file:     "/home/runner/work/server/server/cmd/server/main.go",
+			trimmed:  "cmd/server/main.go",
+		},
+		{
+			name:     "main package closure",
+			mainPkg:  "github.com/curioswitch/server/cmd/server",
+			function: "main.main.func1",
+			file:     "/home/runner/work/server/server/cmd/server/main.go",
+			trimmed:  "cmd/server/main.go",
+		},
+		{
+			name:     "main package at module root",
+			mainPkg:  "github.com/curioswitch/server",
+			function: "main.main",
+			file:     "/home/runner/work/server/server/main.go",
+			trimmed:  "main.go",
+		},
+		{
+			name:     "other module",
+			function: "github.com/curioswitch/other.Run",
+			file:     "/src/other/other.go",
+			trimmed:  "/src/other/other.go",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.trimmed, trimModulePath(mod, tc.mainPkg, tc.function, tc.file))
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package requestlog
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// statusClientClosedRequest is the non-standard status popularized by nginx
+// for requests where the client closed the connection before the response
+// was sent.
+const statusClientClosedRequest = 499
+
+type cancelReason string
+
+const (
+	// cancelReasonClient is a request canceled by the client, generally by
+	// closing the connection.
+	cancelReasonClient cancelReason = "client"
+
+	// cancelReasonTimeout is a request canceled by the server because its
+	// deadline was exceeded.
+	cancelReasonTimeout cancelReason = "timeout"
+)
+
+// cancellation describes a request that was canceled while being served.
+type cancellation struct {
+	reason          cancelReason
+	cause           error
+	handlerFinished bool
+}
+
+func newCancellation(ctx context.Context, handlerFinished bool) *cancellation {
+	cause := context.Cause(ctx)
+	reason := cancelReasonClient
+	if errors.Is(cause, context.DeadlineExceeded) {
+		reason = cancelReasonTimeout
+	}
+	return &cancellation{
+		reason:          reason,
+		cause:           cause,
+		handlerFinished: handlerFinished,
+	}
+}
+
+func (c *cancellation) attr() slog.Attr {
+	return slog.Group("cancellation",
+		slog.String("reason", string(c.reason)),
+		slog.String("cause", c.cause.Error()),
+		slog.Bool("handlerFinished", c.handlerFinished),
+	)
+}
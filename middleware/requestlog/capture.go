@@ -0,0 +1,227 @@
+package requestlog
+
+import (
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CaptureRequestBody returns an Option to record up to limit bytes of the
+// request body in the request log, as httpBody.request. Only the bytes read by
+// the handler are recorded, so streaming requests are not buffered. Use
+// CaptureContentTypes and CaptureStatus to limit which bodies are recorded,
+// and RedactBody to remove sensitive data.
+func CaptureRequestBody(limit int) Option {
+	return captureRequestBodyOption(limit)
+}
+
+type captureRequestBodyOption int
+
+func (o captureRequestBodyOption) apply(conf *config) {
+	conf.captureRequestLimit = int(o)
+}
+
+// CaptureResponseBody returns an Option to record up to limit bytes of the
+// response body in the request log, as httpBody.response. The body is recorded
+// as it is written, so streaming responses are not buffered and the
+// [http.Flusher] and [http.Hijacker] interfaces of the response are preserved.
+// Use CaptureContentTypes and CaptureStatus to limit which bodies are
+// recorded, and RedactBody to remove sensitive data.
+func CaptureResponseBody(limit int) Option {
+	return captureResponseBodyOption(limit)
+}
+
+type captureResponseBodyOption int
+
+func (o captureResponseBodyOption) apply(conf *config) {
+	conf.captureResponseLimit = int(o)
+}
+
+// CaptureContentTypes returns an Option to only capture bodies with one of
+// the given media types, for example "application/json". A subtype of "*"
+// matches any subtype, for example "text/*". If not provided, bodies of any
+// content type are captured.
+func CaptureContentTypes(types ...string) Option {
+	return captureContentTypesOption(types)
+}
+
+type captureContentTypesOption []string
+
+func (o captureContentTypesOption) apply(conf *config) {
+	conf.captureContentTypes = o
+}
+
+// CaptureStatus returns an Option to only record captured bodies for
+// responses with a status for which f returns true, for example to only
+// record the bodies of failed requests.
+func CaptureStatus(f func(status int) bool) Option {
+	return captureStatusOption(f)
+}
+
+type captureStatusOption func(status int) bool
+
+func (o captureStatusOption) apply(conf *config) {
+	conf.captureStatus = o
+}
+
+// RedactBody returns an Option to redact captured bodies before they are
+// logged. f is called with the media type and captured bytes of each body,
+// and returns the bytes to log. The captured bytes may be truncated, so f
+// should handle partial content such as invalid JSON. f must not retain body.
+func RedactBody(f func(contentType string, body []byte) []byte) Option {
+	return redactBodyOption(f)
+}
+
+type redactBodyOption func(contentType string, body []byte) []byte
+
+func (o redactBodyOption) apply(conf *config) {
+	conf.redactBody = o
+}
+
+// appendBodies appends the httpBody group for the captured bodies of a request
+// and its response to logArgs, if captured bodies are recorded for status.
+// Either body may be nil if it was not captured.
+func (c *config) appendBodies(logArgs []any, status int, reqBody *bodyCapture, resBody *bodyCapture) []any {
+	if c.captureStatus != nil && !c.captureStatus(status) {
+		return logArgs
+	}
+	var attrs []any
+	if reqBody != nil {
+		attrs = append(attrs, reqBody.attrs("request", c.redactBody)...)
+	}
+	if resBody != nil {
+		attrs = append(attrs, resBody.attrs("response", c.redactBody)...)
+	}
+	if len(attrs) == 0 {
+		return logArgs
+	}
+	return append(logArgs, slog.Group("httpBody", attrs...))
+}
+
+// bodyCapture records the beginning of a body, up to a limit.
+type bodyCapture struct {
+	contentType string
+	limit       int
+
+	// The body may be read from a different goroutine than the one logging
+	// it.
+	mu        sync.Mutex
+	buf       []byte
+	truncated bool
+}
+
+// newBodyCapture returns a bodyCapture for a body with the header value
+// contentType, or nil if it should not be captured.
+func (c *config) newBodyCapture(limit int, contentType string) *bodyCapture {
+	if limit <= 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if len(c.captureContentTypes) > 0 && !matchMediaType(c.captureContentTypes, mediaType) {
+		return nil
+	}
+	return &bodyCapture{contentType: mediaType, limit: limit}
+}
+
+// Write implements io.Writer, always succeeding even when it does not record p.
+func (b *bodyCapture) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	if remaining := b.limit - len(b.buf); n > remaining {
+		p = p[:remaining]
+		b.truncated = true
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+// WriteString implements io.StringWriter, always succeeding even when it does
+// not record s.
+func (b *bodyCapture) WriteString(s string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(s)
+	if remaining := b.limit - len(b.buf); n > remaining {
+		s = s[:remaining]
+		b.truncated = true
+	}
+	b.buf = append(b.buf, s...)
+	return n, nil
+}
+
+func (b *bodyCapture) attrs(key string, redact func(string, []byte) []byte) []any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	body := b.buf
+	if redact != nil {
+		body = redact(b.contentType, body)
+	}
+	attrs := []any{slog.String(key, string(body))}
+	if b.truncated {
+		attrs = append(attrs, slog.Bool(key+"Truncated", true))
+	}
+	return attrs
+}
+
+// responseCapture captures the response body, determining whether to capture
+// it on the first write when its content type is known.
+type responseCapture struct {
+	conf    *config
+	w       http.ResponseWriter
+	checked bool
+	body    *bodyCapture
+}
+
+func (r *responseCapture) start(p []byte) *bodyCapture {
+	if r.checked {
+		return r.body
+	}
+	r.checked = true
+	contentType := r.w.Header().Get("Content-Type")
+	if contentType == "" && len(p) > 0 && r.w.Header().Get("Content-Encoding") == "" {
+		// Like net/http.
+		contentType = http.DetectContentType(p)
+	}
+	r.body = r.conf.newBodyCapture(r.conf.captureResponseLimit, contentType)
+	return r.body
+}
+
+func (r *responseCapture) write(p []byte) {
+	if b := r.start(p); b != nil {
+		_, _ = b.Write(p)
+	}
+}
+
+func (r *responseCapture) writeString(s string) {
+	if b := r.start([]byte(s[:min(len(s), 512)])); b != nil {
+		_, _ = b.WriteString(s)
+	}
+}
+
+// reader returns src, teeing it to the capture if needed. The tee hides any
+// optimized implementations of src so is only used when capturing.
+func (r *responseCapture) reader(src io.Reader) io.Reader {
+	if b := r.start(nil); b != nil {
+		return io.TeeReader(src, b)
+	}
+	return src
+}
+
+// matchMediaType returns whether mediaType matches any of patterns.
+func matchMediaType(patterns []string, mediaType string) bool {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == mediaType || p == "*/*" {
+			return true
+		}
+		if ptyp, psub, _ := strings.Cut(p, "/"); psub == "*" && ptyp == typ {
+			return true
+		}
+	}
+	return false
+}
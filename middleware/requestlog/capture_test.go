@@ -0,0 +1,172 @@
+package requestlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureBody(t *testing.T) {
+	type bodyRecord struct {
+		Request           string `json:"request,omitempty"`
+		RequestTruncated  bool   `json:"requestTruncated,omitempty"`
+		Response          string `json:"response,omitempty"`
+		ResponseTruncated bool   `json:"responseTruncated,omitempty"`
+	}
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		reqType     string
+		resType     string
+		status      int
+		writeString bool
+
+		body *bodyRecord
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name: "request and response",
+			opts: []Option{CaptureRequestBody(100), CaptureResponseBody(100)},
+			body: &bodyRecord{
+				Request:  `{"animal":"bear"}`,
+				Response: `{"animal":"cat"}`,
+			},
+		},
+		{
+			name:        "response write string",
+			opts:        []Option{CaptureResponseBody(100)},
+			writeString: true,
+			body: &bodyRecord{
+				Response: `{"animal":"cat"}`,
+			},
+		},
+		{
+			name: "truncated",
+			opts: []Option{CaptureRequestBody(5), CaptureResponseBody(6)},
+			body: &bodyRecord{
+				Request:           `{"ani`,
+				RequestTruncated:  true,
+				Response:          `{"anim`,
+				ResponseTruncated: true,
+			},
+		},
+		{
+			name: "content type match",
+			opts: []Option{
+				CaptureRequestBody(100), CaptureResponseBody(100),
+				CaptureContentTypes("application/json"),
+			},
+			reqType: "application/json; charset=utf-8",
+			resType: "application/json",
+			body: &bodyRecord{
+				Request:  `{"animal":"bear"}`,
+				Response: `{"animal":"cat"}`,
+			},
+		},
+		{
+			name: "content type wildcard",
+			opts: []Option{
+				CaptureRequestBody(100), CaptureResponseBody(100),
+				CaptureContentTypes("text/*"),
+			},
+			reqType: "application/json",
+			body: &bodyRecord{
+				// Sniffed as text/plain.
+				Response: `{"animal":"cat"}`,
+			},
+		},
+		{
+			name: "content type mismatch",
+			opts: []Option{
+				CaptureRequestBody(100), CaptureResponseBody(100),
+				CaptureContentTypes("application/json"),
+			},
+			reqType: "application/octet-stream",
+			resType: "image/png",
+		},
+		{
+			name: "status match",
+			opts: []Option{
+				CaptureResponseBody(100),
+				CaptureStatus(func(status int) bool { return status >= 400 }),
+			},
+			status: http.StatusBadRequest,
+			body: &bodyRecord{
+				Response: `{"animal":"cat"}`,
+			},
+		},
+		{
+			name: "status mismatch",
+			opts: []Option{
+				CaptureResponseBody(100),
+				CaptureStatus(func(status int) bool { return status >= 400 }),
+			},
+		},
+		{
+			name: "redact",
+			opts: []Option{
+				CaptureRequestBody(100), CaptureResponseBody(100),
+				RedactBody(func(contentType string, body []byte) []byte {
+					return bytes.ReplaceAll(body, []byte("bear"), []byte(contentType))
+				}),
+			},
+			reqType: "application/json",
+			body: &bodyRecord{
+				Request:  `{"animal":"application/json"}`,
+				Response: `{"animal":"cat"}`,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+			status := tc.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			h := NewMiddleware(append([]Option{Logger(logger)}, tc.opts...)...)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.ReadAll(req.Body)
+				if tc.resType != "" {
+					w.Header().Set("Content-Type", tc.resType)
+				}
+				w.WriteHeader(status)
+				if tc.writeString {
+					_, _ = io.WriteString(w, `{"animal":"cat"}`)
+				} else {
+					_, _ = w.Write([]byte(`{"animal":`))
+					w.(http.Flusher).Flush()
+					_, _ = w.Write([]byte(`"cat"}`))
+				}
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"animal":"bear"}`))
+			if tc.reqType != "" {
+				req.Header.Set("Content-Type", tc.reqType)
+			}
+			res := httptest.NewRecorder()
+			h.ServeHTTP(res, req)
+			require.Equal(t, `{"animal":"cat"}`, res.Body.String())
+			require.True(t, res.Flushed || tc.writeString)
+
+			var rec struct {
+				Body *bodyRecord `json:"httpBody"`
+			}
+			require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+			require.Equal(t, tc.body, rec.Body)
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package requestlog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewTransport returns an [http.RoundTripper] that logs outbound requests sent
+// with base in the same GCP structured format as NewMiddleware, allowing
+// dashboards to treat client and server requests alike. If base is nil,
+// [http.DefaultTransport] is used. Requests are logged with their context, so
+// they are linked with the caller's trace.
+//
+// A request is logged once its response body has been read to the end or
+// closed, so the response size and latency cover the entire response. Requests
+// that fail without a response are logged at ERROR with the error.
+//
+// The options for the logger, levels, skipping and sampling, slow requests,
+// header logging, and body capture apply to outbound requests as they do to
+// server requests. For example, to capture the bodies of failed requests, use
+// CaptureResponseBody with CaptureStatus. Other options are ignored. If the
+// request is a retry, use ContextWithRetryAttempt to record the attempt.
+func NewTransport(base http.RoundTripper, opts ...Option) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{
+		base:   base,
+		config: newConfig(opts),
+	}
+}
+
+type retryAttemptContextKeyType struct{}
+
+var retryAttemptContextKey = retryAttemptContextKeyType{}
+
+// ContextWithRetryAttempt returns a copy of ctx which records attempt as the
+// retryAttempt of requests sent with it by the transport returned by
+// NewTransport. attempt should be 0 for the initial request and increase with
+// each retry.
+func ContextWithRetryAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, retryAttemptContextKey, attempt)
+}
+
+type transport struct {
+	base http.RoundTripper
+	config
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.shouldSkip(req) {
+		return t.base.RoundTrip(req) //nolint:wrapcheck // pass through transport errors
+	}
+
+	call := &clientCall{
+		t:     t,
+		req:   req,
+		start: time.Now(),
+	}
+
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr := info.Conn.RemoteAddr(); addr != nil {
+				call.serverIP.Store(addrIP(addr.String()))
+			}
+		},
+	})
+	// RoundTrippers must not modify the request, so send a copy with our
+	// trace and body.
+	out := req.WithContext(ctx)
+	if req.Body != nil && req.Body != http.NoBody {
+		call.reqBody = &countingBody{
+			ReadCloser: req.Body,
+			capture:    t.newBodyCapture(t.captureRequestLimit, req.Header.Get("Content-Type")),
+		}
+		out.Body = call.reqBody
+	}
+
+	res, err := t.base.RoundTrip(out)
+	if err != nil {
+		call.finish(nil, nil, 0, err)
+		return nil, err //nolint:wrapcheck // pass through transport errors
+	}
+
+	// There is no body to wait for, or the body is a connection for a
+	// protocol upgrade that we must not hide.
+	if res.Body == nil || res.Body == http.NoBody || res.StatusCode == http.StatusSwitchingProtocols {
+		call.finish(res, nil, 0, nil)
+		return res, nil
+	}
+
+	res.Body = &clientResponseBody{
+		ReadCloser: res.Body,
+		call:       call,
+		res:        res,
+		capture:    t.newBodyCapture(t.captureResponseLimit, res.Header.Get("Content-Type")),
+	}
+	return res, nil
+}
+
+// clientCall is the state of a single outbound request.
+type clientCall struct {
+	t     *transport
+	req   *http.Request
+	start time.Time
+
+	reqBody  *countingBody
+	serverIP atomic.Value // string
+}
+
+// finish logs the request with the response res, or the error err if the
+// request failed. resBody is the captured response body, if any, and
+// resSize is the number of bytes of the response body read.
+func (c *clientCall) finish(res *http.Response, resBody *bodyCapture, resSize int64, err error) {
+	duration := time.Since(c.start)
+	t := c.t
+	req := c.req
+
+	status := 0
+	level := slog.LevelError
+	if res != nil {
+		status = res.StatusCode
+		level = t.statusLevel(status)
+	}
+	if t.slowThreshold > 0 && duration >= t.slowThreshold {
+		level = max(level, slog.LevelWarn)
+	}
+	if !t.sampled(level, duration) {
+		return
+	}
+
+	reqAttrs := []any{
+		slog.String("requestMethod", req.Method),
+		slog.String("requestUrl", req.URL.String()),
+		slog.String("latency", fmt.Sprintf("%.9fs", duration.Seconds())),
+	}
+	if c.reqBody != nil {
+		reqAttrs = append(reqAttrs, slog.Int64("requestSize", c.reqBody.n.Load()))
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "" {
+		reqAttrs = append(reqAttrs, slog.String("userAgent", ua))
+	}
+	if referer := req.Header.Get("Referer"); referer != "" {
+		reqAttrs = append(reqAttrs, slog.String("referer", referer))
+	}
+	if ip, ok := c.serverIP.Load().(string); ok {
+		reqAttrs = append(reqAttrs, slog.String("serverIp", ip))
+	}
+	var resHeader http.Header
+	if res != nil {
+		resHeader = res.Header
+		reqAttrs = append(reqAttrs,
+			slog.String("protocol", res.Proto),
+			slog.Int("status", status),
+			slog.Int64("responseSize", resSize),
+		)
+	}
+
+	logArgs := []any{slog.Group("httpRequest", reqAttrs...)}
+	if attempt, ok := req.Context().Value(retryAttemptContextKey).(int); ok {
+		logArgs = append(logArgs, slog.Int("retryAttempt", attempt))
+	}
+	logArgs = t.appendHeaders(logArgs, req.Header, resHeader)
+	var reqBody *bodyCapture
+	if c.reqBody != nil {
+		reqBody = c.reqBody.capture
+	}
+	logArgs = t.appendBodies(logArgs, status, reqBody, resBody)
+	if err != nil {
+		logArgs = append(logArgs, slog.Any("error", err))
+	}
+
+	t.getLogger().Log(req.Context(), level, "Client Request", logArgs...)
+}
+
+// clientResponseBody is a response body that logs the request when it is read
+// to the end or closed.
+type clientResponseBody struct {
+	io.ReadCloser
+
+	call    *clientCall
+	res     *http.Response
+	capture *bodyCapture
+
+	n    atomic.Int64
+	once sync.Once
+}
+
+func (b *clientResponseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	if b.capture != nil {
+		_, _ = b.capture.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err //nolint:wrapcheck // pass through body errors like io.EOF
+}
+
+func (b *clientResponseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err //nolint:wrapcheck // pass through body errors
+}
+
+func (b *clientResponseBody) finish() {
+	b.once.Do(func() {
+		b.call.finish(b.res, b.capture, b.n.Load(), nil)
+	})
+}
@@ -0,0 +1,222 @@
+package requestlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.ReadAll(req.Body)
+		switch req.URL.Path {
+		case "/missing":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"no bears"}`))
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			_, _ = w.Write([]byte("kuma"))
+		}
+	}))
+	defer srv.Close()
+
+	type clientRecord struct {
+		gcpRecord
+
+		RetryAttempt *int `json:"retryAttempt"`
+		Body         *struct {
+			Request  string `json:"request"`
+			Response string `json:"response"`
+		} `json:"httpBody"`
+		Error string `json:"error"`
+	}
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		method  string
+		path    string
+		body    string
+		attempt *int
+		url     string
+
+		level   string
+		status  int
+		resSize int64
+		reqSize int64
+		resBody string
+		err     bool
+		logged  bool
+	}{
+		{
+			name:    "ok",
+			path:    "/bear",
+			level:   "INFO",
+			status:  http.StatusOK,
+			resSize: 4,
+			logged:  true,
+		},
+		{
+			name:    "request body",
+			method:  http.MethodPost,
+			path:    "/bear",
+			body:    "who",
+			level:   "INFO",
+			status:  http.StatusOK,
+			reqSize: 3,
+			resSize: 4,
+			logged:  true,
+		},
+		{
+			name:   "no content",
+			path:   "/empty",
+			level:  "INFO",
+			status: http.StatusNoContent,
+			logged: true,
+		},
+		{
+			name: "capture error body",
+			opts: []Option{
+				CaptureResponseBody(100),
+				CaptureStatus(func(status int) bool { return status >= 400 }),
+			},
+			path:    "/missing",
+			level:   "WARN",
+			status:  http.StatusNotFound,
+			resSize: 20,
+			resBody: `{"error":"no bears"}`,
+			logged:  true,
+		},
+		{
+			name: "capture ok body skipped",
+			opts: []Option{
+				CaptureResponseBody(100),
+				CaptureStatus(func(status int) bool { return status >= 400 }),
+			},
+			path:    "/bear",
+			level:   "INFO",
+			status:  http.StatusOK,
+			resSize: 4,
+			logged:  true,
+		},
+		{
+			name:    "retry",
+			path:    "/bear",
+			attempt: ptr(2),
+			level:   "INFO",
+			status:  http.StatusOK,
+			resSize: 4,
+			logged:  true,
+		},
+		{
+			name:   "skip",
+			opts:   []Option{SkipPaths("/bear")},
+			path:   "/bear",
+			logged: false,
+		},
+		{
+			name:   "error",
+			url:    "http://127.0.0.1:0/bear",
+			level:  "ERROR",
+			err:    true,
+			logged: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+			client := &http.Client{
+				Transport: NewTransport(nil, append([]Option{Logger(logger)}, tc.opts...)...),
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			url := tc.url
+			if url == "" {
+				url = srv.URL + tc.path
+			}
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+
+			ctx := t.Context()
+			if tc.attempt != nil {
+				ctx = ContextWithRetryAttempt(ctx, *tc.attempt)
+			}
+			req, err := http.NewRequestWithContext(ctx, method, url, body)
+			require.NoError(t, err)
+			res, err := client.Do(req)
+			if tc.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				_, _ = io.ReadAll(res.Body)
+				require.NoError(t, res.Body.Close())
+			}
+
+			if !tc.logged {
+				require.Empty(t, output.String())
+				return
+			}
+
+			var rec clientRecord
+			require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+			require.Equal(t, "Client Request", rec.Message)
+			require.Equal(t, tc.level, rec.Level)
+			require.Equal(t, method, rec.HTTPRequest.RequestMethod)
+			require.Equal(t, url, rec.HTTPRequest.RequestURL)
+			require.Equal(t, tc.status, rec.HTTPRequest.Status)
+			require.Equal(t, tc.reqSize, rec.HTTPRequest.RequestSize)
+			require.Equal(t, tc.resSize, rec.HTTPRequest.ResponseSize)
+			require.NotEmpty(t, rec.HTTPRequest.Latency)
+			require.Equal(t, tc.attempt, rec.RetryAttempt)
+			if tc.err {
+				require.NotEmpty(t, rec.Error)
+			} else {
+				require.Equal(t, "HTTP/1.1", rec.HTTPRequest.Protocol)
+				require.Equal(t, "127.0.0.1", rec.HTTPRequest.ServerIP)
+			}
+			if tc.resBody != "" {
+				require.Equal(t, tc.resBody, rec.Body.Response)
+			} else {
+				require.Nil(t, rec.Body)
+			}
+		})
+	}
+}
+
+func TestTransportLogOnce(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("kuma"))
+	}))
+	defer srv.Close()
+
+	var output bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+	client := &http.Client{Transport: NewTransport(nil, Logger(logger))}
+
+	res, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	_, _ = io.ReadAll(res.Body)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 1, strings.Count(output.String(), "\n"))
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,142 @@
+package requestlog
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies returns an Option to trust forwarding headers added by
+// proxies within the given prefixes when determining the client IP of a
+// request. Addresses in the X-Forwarded-For header, or the Forwarded header
+// with ForwardedHeader, are checked from the right, skipping trusted proxies,
+// and the first untrusted address is used as the client IP. Can be combined
+// with TrustedHops.
+func TrustedProxies(prefixes ...netip.Prefix) Option {
+	return trustedProxiesOption(prefixes)
+}
+
+type trustedProxiesOption []netip.Prefix
+
+func (o trustedProxiesOption) apply(conf *config) {
+	conf.trustedProxies = append(conf.trustedProxies, o...)
+}
+
+// TrustedHops returns an Option to trust the given number of proxies in front
+// of the server, including the one connecting to it, when determining the
+// client IP of a request. This is useful when the addresses of proxies are not
+// known but their number is, for example when running behind a Google Cloud
+// load balancer, which appends both the client's address and its own to
+// X-Forwarded-For, a value of 2 will use the client's address. Can be
+// combined with TrustedProxies.
+func TrustedHops(n int) Option {
+	return trustedHopsOption(n)
+}
+
+type trustedHopsOption int
+
+func (o trustedHopsOption) apply(conf *config) {
+	conf.trustedHops = int(o)
+}
+
+// ForwardedHeader returns an Option to read the addresses of trusted proxies
+// from the standard Forwarded header instead of X-Forwarded-For. Only use it
+// if the proxies in front of the server append to Forwarded, otherwise a
+// client can set the header to choose its own IP. Google Cloud load balancers
+// and Cloud Run only append to X-Forwarded-For.
+func ForwardedHeader() Option {
+	return forwardedHeaderOption{}
+}
+
+type forwardedHeaderOption struct{}
+
+func (o forwardedHeaderOption) apply(conf *config) {
+	conf.forwardedHeader = true
+}
+
+// clientIP returns the IP address of the client of a request with header
+// from remoteAddr, without the port.
+func (c *config) clientIP(header http.Header, remoteAddr string) string {
+	remote, ok := parseAddr(remoteAddr)
+	if !ok {
+		return remoteAddr
+	}
+	if c.trustedHops == 0 && len(c.trustedProxies) == 0 {
+		return remote.String()
+	}
+
+	var chain []string
+	if c.forwardedHeader {
+		chain = forwarded(header)
+	} else {
+		chain = xForwardedFor(header)
+	}
+	chain = append(chain, remoteAddr)
+
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseAddr(chain[i])
+		if !ok {
+			// Can't trust anything past an invalid entry, so use the last
+			// valid one.
+			break
+		}
+		client = addr
+		if hop := len(chain) - 1 - i; hop >= c.trustedHops && !c.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+func (c *config) isTrustedProxy(addr netip.Addr) bool {
+	for _, p := range c.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded returns the addresses of clients and proxies that forwarded a
+// request, in order, from the standard Forwarded header.
+func forwarded(h http.Header) []string {
+	var res []string
+	for _, v := range h.Values("Forwarded") {
+		for elem := range strings.SplitSeq(v, ",") {
+			for pair := range strings.SplitSeq(elem, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					res = append(res, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return res
+}
+
+// xForwardedFor returns the addresses of clients and proxies that forwarded a
+// request, in order, from the X-Forwarded-For header.
+func xForwardedFor(h http.Header) []string {
+	var res []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for addr := range strings.SplitSeq(v, ",") {
+			res = append(res, strings.TrimSpace(addr))
+		}
+	}
+	return res
+}
+
+// parseAddr parses an IP address, with or without a port.
+func parseAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
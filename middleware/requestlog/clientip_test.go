@@ -0,0 +1,146 @@
+package requestlog
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		remoteAddr string
+		headers    map[string][]string
+
+		clientIP string
+	}{
+		{
+			name:       "remote addr",
+			remoteAddr: "192.0.2.1:1234",
+			clientIP:   "192.0.2.1",
+		},
+		{
+			name:       "remote addr ipv6",
+			remoteAddr: "[2001:db8::1]:1234",
+			clientIP:   "2001:db8::1",
+		},
+		{
+			name:       "remote addr invalid",
+			remoteAddr: "@",
+			clientIP:   "@",
+		},
+		{
+			name:       "forwarded untrusted",
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.1"}},
+			clientIP:   "192.0.2.1",
+		},
+		{
+			name:       "forwarded trusted proxy",
+			opts:       []Option{TrustedProxies(netip.MustParsePrefix("192.0.2.0/24"))},
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.1"}},
+			clientIP:   "203.0.113.1",
+		},
+		{
+			name: "forwarded multiple trusted proxies",
+			opts: []Option{TrustedProxies(
+				netip.MustParsePrefix("192.0.2.0/24"),
+				netip.MustParsePrefix("203.0.113.0/24"),
+			)},
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.1", "203.0.113.2"}},
+			clientIP:   "198.51.100.1",
+		},
+		{
+			name:       "forwarded all trusted",
+			opts:       []Option{TrustedProxies(netip.MustParsePrefix("0.0.0.0/0"))},
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.1"}},
+			clientIP:   "198.51.100.1",
+		},
+		{
+			name:       "forwarded hops",
+			opts:       []Option{TrustedHops(2)},
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.1"}},
+			clientIP:   "198.51.100.1",
+		},
+		{
+			name:       "forwarded hops spoofed",
+			opts:       []Option{TrustedHops(2)},
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.0.0.1, 198.51.100.1, 203.0.113.1"}},
+			clientIP:   "198.51.100.1",
+		},
+		{
+			name:       "forwarded hops with port",
+			opts:       []Option{TrustedHops(1)},
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1:5678"}},
+			clientIP:   "198.51.100.1",
+		},
+		{
+			name:       "forwarded invalid",
+			opts:       []Option{TrustedHops(3)},
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1, bear, 203.0.113.1"}},
+			clientIP:   "203.0.113.1",
+		},
+		{
+			name:       "forwarded header ignored",
+			opts:       []Option{TrustedHops(2)},
+			remoteAddr: "192.0.2.1:1234",
+			headers: map[string][]string{
+				"Forwarded":       {`for=6.6.6.6`},
+				"X-Forwarded-For": {"198.51.100.7, 34.1.1.1"},
+			},
+			clientIP: "198.51.100.7",
+		},
+		{
+			name:       "forwarded header",
+			opts:       []Option{TrustedHops(2), ForwardedHeader()},
+			remoteAddr: "192.0.2.1:1234",
+			headers: map[string][]string{
+				"Forwarded":       {`for=198.51.100.1;proto=https, For="[2001:db8:cafe::17]:4711";by=192.0.2.1`},
+				"X-Forwarded-For": {"203.0.113.1"},
+			},
+			clientIP: "198.51.100.1",
+		},
+		{
+			name:       "forwarded header ipv6",
+			opts:       []Option{TrustedHops(1), ForwardedHeader()},
+			remoteAddr: "192.0.2.1:1234",
+			headers: map[string][]string{
+				"Forwarded": {`for=198.51.100.1`, `for="[2001:db8:cafe::17]:4711"`},
+			},
+			clientIP: "2001:db8:cafe::17",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.headers {
+				req.Header[k] = v
+			}
+
+			var clientIP string
+			opts := append([]Option{Logger(slog.New(slog.DiscardHandler))}, tc.opts...)
+			h := NewMiddleware(opts...)(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+				clientIP = ClientIPFromContext(req.Context())
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			require.Equal(t, tc.clientIP, clientIP)
+		})
+	}
+
+	require.Empty(t, ClientIPFromContext(t.Context()))
+}
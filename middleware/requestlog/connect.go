@@ -0,0 +1,198 @@
+package requestlog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"connectrpc.com/connect"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// NewConnectInterceptor returns a [connect.Interceptor] that logs requests to
+// Connect handlers in the same GCP structured format as NewMiddleware. Unlike
+// the middleware, which only sees the HTTP status of the response and records
+// most errors as 200 for the Connect protocol, the interceptor maps the
+// Connect error code to the closest HTTP status for httpRequest.status, which
+// determines the level of the log. The procedure, stream type, peer protocol
+// (connect, grpc or grpcweb), error code, message and details, and number of
+// messages are recorded in the connect group. Handlers can use AddExtraAttr
+// and ExtraAttrsFromContext as with HTTP.
+//
+// The interceptor should be used instead of the middleware for Connect
+// handlers, not in addition to it, to avoid logging each request twice.
+// Options specific to HTTP, such as Skip, RouteLevel or CaptureRequestBody,
+// are ignored. With Recover, panics are returned to the client as
+// [connect.CodeInternal] without calling its function. The interceptor has
+// no effect on clients.
+func NewConnectInterceptor(opts ...Option) connect.Interceptor {
+	return &connectInterceptor{rpc: newRPCInterceptor(opts)}
+}
+
+type connectInterceptor struct {
+	rpc *rpcInterceptor
+}
+
+var errInternal = errors.New("internal error")
+
+// WrapUnary implements connect.Interceptor.
+func (i *connectInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (res connect.AnyResponse, err error) {
+		if req.Spec().IsClient {
+			return next(ctx, req)
+		}
+
+		call := i.start(ctx, req.Spec(), req.Peer(), req.Header(), req.HTTPMethod())
+		defer func() {
+			servePanic := recover()
+			if servePanic != nil && i.rpc.recover {
+				err = connect.NewError(connect.CodeInternal, errInternal)
+			}
+			if id := call.state.requestID; id != "" {
+				var connectErr *connect.Error
+				switch {
+				case servePanic == nil && err == nil && res != nil:
+					res.Header().Set(i.rpc.requestIDHeader, id)
+				case errors.As(err, &connectErr):
+					connectErr.Meta().Set(i.rpc.requestIDHeader, id)
+				}
+			}
+			sent := int64(0)
+			if err == nil && servePanic == nil {
+				sent = 1
+			}
+			i.finish(call, req.Spec(), req.Peer(), servePanic, err, 1, sent)
+		}()
+		return next(call.ctx, req)
+	}
+}
+
+// WrapStreamingClient implements connect.Interceptor.
+func (i *connectInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+// WrapStreamingHandler implements connect.Interceptor.
+func (i *connectInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) (err error) {
+		call := i.start(ctx, conn.Spec(), conn.Peer(), conn.RequestHeader(), http.MethodPost)
+		if id := call.state.requestID; id != "" {
+			conn.ResponseHeader().Set(i.rpc.requestIDHeader, id)
+		}
+		counted := &countingHandlerConn{StreamingHandlerConn: conn}
+		defer func() {
+			servePanic := recover()
+			if servePanic != nil && i.rpc.recover {
+				err = connect.NewError(connect.CodeInternal, errInternal)
+			}
+			i.finish(call, conn.Spec(), conn.Peer(), servePanic, err, counted.received.Load(), counted.sent.Load())
+		}()
+		return next(call.ctx, counted)
+	}
+}
+
+func (i *connectInterceptor) start(ctx context.Context, spec connect.Spec, peer connect.Peer, header http.Header, method string) *rpcCall {
+	reqAttrs := []any{
+		slog.String("requestMethod", method),
+		slog.String("requestUrl", spec.Procedure),
+	}
+	if ua := header.Get("User-Agent"); ua != "" {
+		reqAttrs = append(reqAttrs, slog.String("userAgent", ua))
+	}
+	if referer := header.Get("Referer"); referer != "" {
+		reqAttrs = append(reqAttrs, slog.String("referer", referer))
+	}
+
+	var reqID string
+	if i.rpc.requestIDHeader != "" {
+		reqID = header.Get(i.rpc.requestIDHeader)
+	}
+	return i.rpc.start(ctx, spec.Procedure, i.rpc.clientIP(header, peer.Addr), reqID, reqAttrs)
+}
+
+func (i *connectInterceptor) finish(call *rpcCall, spec connect.Spec, peer connect.Peer, servePanic any, err error, received int64, sent int64) {
+	connectAttrs := []any{
+		slog.String("procedure", spec.Procedure),
+		slog.String("streamType", spec.StreamType.String()),
+		slog.String("protocol", peer.Protocol),
+	}
+
+	if servePanic != nil && err == nil {
+		// A panic propagated to the server is also an internal error for the
+		// client.
+		err = connect.NewError(connect.CodeInternal, errInternal)
+	}
+
+	status := http.StatusOK
+	if err == nil {
+		connectAttrs = append(connectAttrs, slog.String("code", "ok"))
+	} else {
+		code := connect.CodeOf(err)
+		// Connect codes have the same values as gRPC codes.
+		status = grpcHTTPStatus(codes.Code(code))
+		connectAttrs = append(connectAttrs, slog.String("code", code.String()))
+		var connectErr *connect.Error
+		if errors.As(err, &connectErr) {
+			connectAttrs = append(connectAttrs, slog.String("message", connectErr.Message()))
+			if details := connectErr.Details(); len(details) > 0 {
+				connectAttrs = append(connectAttrs, slog.Any("details", connectDetails(details)))
+			}
+		} else {
+			connectAttrs = append(connectAttrs, slog.String("message", err.Error()))
+		}
+	}
+	connectAttrs = append(connectAttrs,
+		slog.Int64("messagesReceived", received),
+		slog.Int64("messagesSent", sent),
+	)
+
+	i.rpc.finish(call, servePanic, status, slog.Group("connect", connectAttrs...))
+}
+
+// connectDetail is an error detail in the request log, with its value
+// rendered using the protobuf JSON mapping if its type is known.
+type connectDetail struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func connectDetails(details []*connect.ErrorDetail) []connectDetail {
+	res := make([]connectDetail, len(details))
+	for i, d := range details {
+		res[i].Type = d.Type()
+		if m, err := d.Value(); err == nil {
+			if b, err := protojson.Marshal(m); err == nil {
+				res[i].Value = b
+			}
+		}
+	}
+	return res
+}
+
+// countingHandlerConn is a connect.StreamingHandlerConn that counts messages.
+type countingHandlerConn struct {
+	connect.StreamingHandlerConn
+
+	received atomic.Int64
+	sent     atomic.Int64
+}
+
+func (c *countingHandlerConn) Receive(m any) error {
+	if err := c.StreamingHandlerConn.Receive(m); err != nil {
+		return err //nolint:wrapcheck // pass through stream errors like io.EOF
+	}
+	c.received.Add(1)
+	return nil
+}
+
+func (c *countingHandlerConn) Send(m any) error {
+	if err := c.StreamingHandlerConn.Send(m); err != nil {
+		return err //nolint:wrapcheck // pass through stream errors
+	}
+	c.sent.Add(1)
+	return nil
+}
@@ -0,0 +1,206 @@
+package requestlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type connectRecord struct {
+	gcpRecord
+
+	Connect struct {
+		Procedure  string `json:"procedure"`
+		StreamType string `json:"streamType"`
+		Protocol   string `json:"protocol"`
+		Code       string `json:"code"`
+		Message    string `json:"message"`
+		Details    []struct {
+			Type  string `json:"type"`
+			Value any    `json:"value"`
+		} `json:"details"`
+		MessagesReceived int `json:"messagesReceived"`
+		MessagesSent     int `json:"messagesSent"`
+	} `json:"connect"`
+	RequestID string `json:"requestId"`
+}
+
+func TestConnectInterceptor(t *testing.T) {
+	var output syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+	interceptor := NewConnectInterceptor(Logger(logger), RequestID(""), Recover(nil))
+
+	mux := http.NewServeMux()
+	mux.Handle("/zoo.Animals/GetAnimal", connect.NewUnaryHandler("/zoo.Animals/GetAnimal",
+		func(ctx context.Context, req *connect.Request[wrapperspb.StringValue]) (*connect.Response[wrapperspb.StringValue], error) {
+			AddExtraAttr(ctx, slog.String("animal", req.Msg.GetValue()))
+			switch req.Msg.GetValue() {
+			case "cat":
+				err := connect.NewError(connect.CodeNotFound, errors.New("no cats"))
+				detail, _ := connect.NewErrorDetail(wrapperspb.String("only bears"))
+				err.AddDetail(detail)
+				return nil, err
+			case "panda":
+				panic("failure")
+			}
+			return connect.NewResponse(wrapperspb.String("kuma")), nil
+		},
+		connect.WithInterceptors(interceptor),
+	))
+	mux.Handle("/zoo.Animals/ListAnimals", connect.NewServerStreamHandler("/zoo.Animals/ListAnimals",
+		func(_ context.Context, _ *connect.Request[wrapperspb.StringValue], stream *connect.ServerStream[wrapperspb.StringValue]) error {
+			for _, a := range []string{"bear", "cat"} {
+				if err := stream.Send(wrapperspb.String(a)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		connect.WithInterceptors(interceptor),
+	))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	getAnimal := func(opts ...connect.ClientOption) *connect.Client[wrapperspb.StringValue, wrapperspb.StringValue] {
+		return connect.NewClient[wrapperspb.StringValue, wrapperspb.StringValue](srv.Client(), srv.URL+"/zoo.Animals/GetAnimal", opts...)
+	}
+
+	t.Run("unary", func(t *testing.T) {
+		output.Reset()
+
+		req := connect.NewRequest(wrapperspb.String("bear"))
+		req.Header().Set("X-Request-Id", "abcd-1234")
+		res, err := getAnimal().CallUnary(t.Context(), req)
+		require.NoError(t, err)
+		require.Equal(t, "abcd-1234", res.Header().Get("X-Request-Id"))
+
+		var rec connectRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "INFO", rec.Level)
+		require.Equal(t, http.MethodPost, rec.HTTPRequest.RequestMethod)
+		require.Equal(t, "/zoo.Animals/GetAnimal", rec.HTTPRequest.RequestURL)
+		require.Equal(t, "127.0.0.1", rec.HTTPRequest.RemoteIP)
+		require.Equal(t, http.StatusOK, rec.HTTPRequest.Status)
+		require.NotEmpty(t, rec.HTTPRequest.UserAgent)
+		require.Equal(t, "/zoo.Animals/GetAnimal", rec.Connect.Procedure)
+		require.Equal(t, "unary", rec.Connect.StreamType)
+		require.Equal(t, "connect", rec.Connect.Protocol)
+		require.Equal(t, "ok", rec.Connect.Code)
+		require.Equal(t, 1, rec.Connect.MessagesReceived)
+		require.Equal(t, 1, rec.Connect.MessagesSent)
+		require.Equal(t, "abcd-1234", rec.RequestID)
+		require.Equal(t, "bear", rec.Animal)
+	})
+
+	t.Run("unary error grpcweb", func(t *testing.T) {
+		output.Reset()
+
+		_, err := getAnimal(connect.WithGRPCWeb()).CallUnary(t.Context(), connect.NewRequest(wrapperspb.String("cat")))
+		require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+		var connectErr *connect.Error
+		require.ErrorAs(t, err, &connectErr)
+		require.NotEmpty(t, connectErr.Meta().Get("X-Request-Id"))
+
+		var rec connectRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "WARN", rec.Level)
+		require.Equal(t, http.StatusNotFound, rec.HTTPRequest.Status)
+		require.Equal(t, "grpcweb", rec.Connect.Protocol)
+		require.Equal(t, "not_found", rec.Connect.Code)
+		require.Equal(t, "no cats", rec.Connect.Message)
+		require.Len(t, rec.Connect.Details, 1)
+		require.Equal(t, "google.protobuf.StringValue", rec.Connect.Details[0].Type)
+		require.Equal(t, "only bears", rec.Connect.Details[0].Value)
+		require.Equal(t, 0, rec.Connect.MessagesSent)
+		require.Equal(t, connectErr.Meta().Get("X-Request-Id"), rec.RequestID)
+	})
+
+	t.Run("unary panic", func(t *testing.T) {
+		output.Reset()
+
+		_, err := getAnimal().CallUnary(t.Context(), connect.NewRequest(wrapperspb.String("panda")))
+		require.Equal(t, connect.CodeInternal, connect.CodeOf(err))
+
+		var rec connectRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "ERROR", rec.Level)
+		require.Equal(t, "panic: failure", rec.Message)
+		require.Equal(t, reportedErrorEventType, rec.Type)
+		require.Equal(t, http.StatusInternalServerError, rec.HTTPRequest.Status)
+		require.Equal(t, "internal", rec.Connect.Code)
+		require.Equal(t, "panda", rec.Animal)
+	})
+
+	t.Run("server stream", func(t *testing.T) {
+		output.Reset()
+
+		client := connect.NewClient[wrapperspb.StringValue, wrapperspb.StringValue](srv.Client(), srv.URL+"/zoo.Animals/ListAnimals")
+		stream, err := client.CallServerStream(t.Context(), connect.NewRequest(wrapperspb.String("all")))
+		require.NoError(t, err)
+		n := 0
+		for stream.Receive() {
+			n++
+		}
+		require.NoError(t, stream.Err())
+		require.Equal(t, 2, n)
+		require.NotEmpty(t, stream.ResponseHeader().Get("X-Request-Id"))
+
+		var rec connectRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "INFO", rec.Level)
+		require.Equal(t, "server", rec.Connect.StreamType)
+		require.Equal(t, "ok", rec.Connect.Code)
+		require.Equal(t, 1, rec.Connect.MessagesReceived)
+		require.Equal(t, 2, rec.Connect.MessagesSent)
+	})
+}
+
+func TestConnectInterceptorPanic(t *testing.T) {
+	t.Run("propagate", func(t *testing.T) {
+		var output bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+		interceptor := NewConnectInterceptor(Logger(logger), RequestID(""))
+
+		unary := interceptor.WrapUnary(func(context.Context, connect.AnyRequest) (connect.AnyResponse, error) {
+			panic("failure")
+		})
+		require.PanicsWithValue(t, "failure", func() {
+			_, _ = unary(t.Context(), connect.NewRequest(wrapperspb.String("panda")))
+		})
+
+		var rec connectRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "ERROR", rec.Level)
+		require.Equal(t, "panic: failure", rec.Message)
+		require.Equal(t, http.StatusInternalServerError, rec.HTTPRequest.Status)
+		require.Equal(t, "internal", rec.Connect.Code)
+		require.Equal(t, 1, rec.Connect.MessagesReceived)
+		require.Zero(t, rec.Connect.MessagesSent)
+	})
+
+	t.Run("nil response", func(t *testing.T) {
+		var output bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+		interceptor := NewConnectInterceptor(Logger(logger), RequestID(""))
+
+		unary := interceptor.WrapUnary(func(context.Context, connect.AnyRequest) (connect.AnyResponse, error) {
+			return nil, nil //nolint:nilnil // testing a misbehaving handler
+		})
+		require.NotPanics(t, func() {
+			_, _ = unary(t.Context(), connect.NewRequest(wrapperspb.String("panda")))
+		})
+
+		var rec connectRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "ok", rec.Connect.Code)
+	})
+}
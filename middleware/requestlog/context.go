@@ -0,0 +1,86 @@
+package requestlog
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+type requestStateContextKeyType struct{}
+
+var requestStateContextKey = requestStateContextKeyType{}
+
+// requestState is the state of a request shared between the middleware and
+// the handler through the request context.
+type requestState struct {
+	clientIP  string
+	requestID string
+	extra     *ExtraAttrs
+
+	// mu guards the fields below, which may be set by the handler from any
+	// goroutine and read by the in-flight warning while the request is being
+	// served.
+	mu          sync.Mutex
+	cache       *CacheInfo
+	route       string
+	handlerName string
+	childLogged bool
+	childLevel  slog.Level
+}
+
+func stateFromContext(ctx context.Context) *requestState {
+	if s, ok := ctx.Value(requestStateContextKey).(*requestState); ok {
+		return s
+	}
+	return nil
+}
+
+// ClientIPFromContext returns the IP address of the client of the request for
+// the given context, taking into account trusted proxies configured with
+// TrustedProxies or TrustedHops. If the context does not originate from the
+// requestlog middleware, it returns an empty string.
+func ClientIPFromContext(ctx context.Context) string {
+	if s := stateFromContext(ctx); s != nil {
+		return s.clientIP
+	}
+	return ""
+}
+
+// AddExtraAttr adds an extra [slog.Attr] record with the request log for the
+// given context. If the context does not originate from the requestlog middleware,
+// it is ignored. It is equivalent to calling [ExtraAttrs.Add] on the result of
+// ExtraAttrsFromContext.
+func AddExtraAttr(ctx context.Context, attr slog.Attr) {
+	ExtraAttrsFromContext(ctx).Add(attr)
+}
+
+// CacheInfo is information about the caching of a response, recorded in the
+// cache fields of the request log.
+type CacheInfo struct {
+	// Lookup is whether a cache lookup was attempted.
+	Lookup bool
+
+	// Hit is whether the response was served from cache, with or without
+	// validation.
+	Hit bool
+
+	// ValidatedWithOriginServer is whether the response was validated with
+	// the origin server before being served from cache. Only meaningful if Hit
+	// is true.
+	ValidatedWithOriginServer bool
+
+	// FillBytes is the number of response bytes inserted into cache. Only
+	// recorded if a cache fill was attempted.
+	FillBytes int64
+}
+
+// SetCacheInfo sets the cache information recorded with the request log for
+// the given context. If the context does not originate from the requestlog
+// middleware, it is ignored.
+func SetCacheInfo(ctx context.Context, info CacheInfo) {
+	if s := stateFromContext(ctx); s != nil {
+		s.mu.Lock()
+		s.cache = &info
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,149 @@
+package requestlog
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// ExtraAttrs is a set of extra attributes and labels recorded with the request
+// log, which handlers can add to while serving the request. It is safe to use
+// from multiple goroutines. All methods can be called on a nil ExtraAttrs,
+// which ignores any changes, so handlers can use it without checking whether
+// the requestlog middleware is present.
+type ExtraAttrs struct {
+	shared  *extraAttrsShared
+	entries []extraAttrsEntry
+}
+
+// extraAttrsShared is the state shared by ExtraAttrs and the groups created
+// from it.
+type extraAttrsShared struct {
+	mu     sync.Mutex
+	labels map[string]string
+}
+
+type extraAttrsEntry struct {
+	attr slog.Attr
+	// group is the contents of a group added with Group, named attr.Key.
+	group *ExtraAttrs
+}
+
+func newExtraAttrs() *ExtraAttrs {
+	return &ExtraAttrs{shared: &extraAttrsShared{}}
+}
+
+// ExtraAttrsFromContext returns the ExtraAttrs of the request for the given
+// context. If the context does not originate from the requestlog middleware
+// or ContextWithExtraAttrs, it returns nil, which ignores any changes.
+func ExtraAttrsFromContext(ctx context.Context) *ExtraAttrs {
+	if s := stateFromContext(ctx); s != nil {
+		return s.extra
+	}
+	return nil
+}
+
+// ContextWithExtraAttrs returns a copy of ctx with a new, empty ExtraAttrs,
+// for example to verify the attributes added by a handler in tests without
+// the requestlog middleware.
+func ContextWithExtraAttrs(ctx context.Context) (context.Context, *ExtraAttrs) {
+	extra := newExtraAttrs()
+	return context.WithValue(ctx, requestStateContextKey, &requestState{extra: extra}), extra
+}
+
+// Add adds attrs, keeping any existing attributes with the same keys.
+func (e *ExtraAttrs) Add(attrs ...slog.Attr) {
+	if e == nil {
+		return
+	}
+	e.shared.mu.Lock()
+	defer e.shared.mu.Unlock()
+	for _, a := range attrs {
+		e.entries = append(e.entries, extraAttrsEntry{attr: a})
+	}
+}
+
+// Set adds attrs, replacing any existing attribute or group with the same key.
+func (e *ExtraAttrs) Set(attrs ...slog.Attr) {
+	if e == nil {
+		return
+	}
+	e.shared.mu.Lock()
+	defer e.shared.mu.Unlock()
+	for _, a := range attrs {
+		e.entries = slices.DeleteFunc(e.entries, func(entry extraAttrsEntry) bool {
+			return entry.attr.Key == a.Key
+		})
+		e.entries = append(e.entries, extraAttrsEntry{attr: a})
+	}
+}
+
+// Group returns the ExtraAttrs for attributes in the group with the given
+// name, creating it if needed. Calling Group again with the same name returns
+// the same group.
+func (e *ExtraAttrs) Group(name string) *ExtraAttrs {
+	if e == nil {
+		return nil
+	}
+	e.shared.mu.Lock()
+	defer e.shared.mu.Unlock()
+	for _, entry := range e.entries {
+		if entry.group != nil && entry.attr.Key == name {
+			return entry.group
+		}
+	}
+	g := &ExtraAttrs{shared: e.shared}
+	e.entries = append(e.entries, extraAttrsEntry{attr: slog.Attr{Key: name}, group: g})
+	return g
+}
+
+// SetLabel sets a label of the request log, which Cloud Logging records as
+// logging.googleapis.com/labels. Unlike attributes, labels are indexed, which
+// makes them convenient for filtering and log-based metrics. Labels are shared
+// by all groups.
+func (e *ExtraAttrs) SetLabel(key string, value string) {
+	if e == nil {
+		return
+	}
+	e.shared.mu.Lock()
+	defer e.shared.mu.Unlock()
+	if e.shared.labels == nil {
+		e.shared.labels = map[string]string{}
+	}
+	e.shared.labels[key] = value
+}
+
+// Attrs returns a copy of the current attributes, with groups as attributes
+// of [slog.KindGroup].
+func (e *ExtraAttrs) Attrs() []slog.Attr {
+	if e == nil {
+		return nil
+	}
+	e.shared.mu.Lock()
+	defer e.shared.mu.Unlock()
+	return e.attrsLocked()
+}
+
+func (e *ExtraAttrs) attrsLocked() []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(e.entries))
+	for _, entry := range e.entries {
+		if entry.group != nil {
+			attrs = append(attrs, slog.Attr{Key: entry.attr.Key, Value: slog.GroupValue(entry.group.attrsLocked()...)})
+		} else {
+			attrs = append(attrs, entry.attr)
+		}
+	}
+	return attrs
+}
+
+// Labels returns a copy of the current labels.
+func (e *ExtraAttrs) Labels() map[string]string {
+	if e == nil {
+		return nil
+	}
+	e.shared.mu.Lock()
+	defer e.shared.mu.Unlock()
+	return maps.Clone(e.shared.labels)
+}
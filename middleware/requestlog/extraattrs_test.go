@@ -0,0 +1,96 @@
+package requestlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtraAttrs(t *testing.T) {
+	ctx, extra := ContextWithExtraAttrs(t.Context())
+	require.Same(t, extra, ExtraAttrsFromContext(ctx))
+
+	extra.Add(slog.String("animal", "bear"), slog.Int("count", 1))
+	extra.Add(slog.String("animal", "cat"))
+	extra.Set(slog.Int("count", 2))
+	AddExtraAttr(ctx, slog.String("color", "brown"))
+
+	g := extra.Group("zoo")
+	g.Set(slog.String("name", "ueno"))
+	g.Set(slog.String("name", "tama"))
+	require.Same(t, g, extra.Group("zoo"))
+	g.SetLabel("zoo", "tama")
+	extra.SetLabel("animal", "bear")
+
+	require.Equal(t, []slog.Attr{
+		slog.String("animal", "bear"),
+		slog.String("animal", "cat"),
+		slog.Int("count", 2),
+		slog.String("color", "brown"),
+		slog.Group("zoo", slog.String("name", "tama")),
+	}, extra.Attrs())
+	require.Equal(t, map[string]string{
+		"animal": "bear",
+		"zoo":    "tama",
+	}, extra.Labels())
+
+	extra.Set(slog.String("zoo", "none"))
+	require.Equal(t, slog.String("zoo", "none"), extra.Attrs()[4])
+}
+
+func TestExtraAttrsNil(t *testing.T) {
+	extra := ExtraAttrsFromContext(t.Context())
+	require.Nil(t, extra)
+
+	extra.Add(slog.String("animal", "bear"))
+	extra.Set(slog.String("animal", "bear"))
+	extra.Group("zoo").Add(slog.String("name", "tama"))
+	extra.SetLabel("animal", "bear")
+	AddExtraAttr(t.Context(), slog.String("animal", "bear"))
+
+	require.Nil(t, extra.Attrs())
+	require.Nil(t, extra.Labels())
+}
+
+func TestExtraAttrsMiddleware(t *testing.T) {
+	var output bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, req *http.Request) {
+		extra := ExtraAttrsFromContext(req.Context())
+		var wg sync.WaitGroup
+		for i := range 10 {
+			wg.Go(func() {
+				extra.Group("workers").Set(slog.Int("worker"+strconv.Itoa(i), i))
+				extra.Set(slog.String("animal", "bear"))
+				extra.SetLabel("tenant", "zoo")
+			})
+		}
+		wg.Wait()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	h := NewMiddleware(Logger(logger), RouteLabels())(mux)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/1", nil))
+
+	var rec struct {
+		Animal  string            `json:"animal"`
+		Workers map[string]int    `json:"workers"`
+		Labels  map[string]string `json:"logging.googleapis.com/labels"`
+	}
+	require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+	require.Equal(t, "bear", rec.Animal)
+	require.Len(t, rec.Workers, 10)
+	require.Equal(t, map[string]string{
+		"route":  "GET /users/{id}",
+		"tenant": "zoo",
+	}, rec.Labels)
+}
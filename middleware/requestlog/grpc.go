@@ -0,0 +1,195 @@
+package requestlog
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor returns a [grpc.UnaryServerInterceptor] that logs
+// requests in the same GCP structured format as NewMiddleware. The gRPC status
+// code is mapped to the closest HTTP status for httpRequest.status, which
+// determines the level of the log, and the method, status code and number of
+// messages are recorded in the grpc group. Handlers can use AddExtraAttr and
+// ExtraAttrsFromContext as with HTTP.
+//
+// Options specific to HTTP, such as Skip, RouteLevel or CaptureRequestBody,
+// are ignored. With Recover, panics are returned to the client as
+// [codes.Internal] without calling its function.
+func UnaryServerInterceptor(opts ...Option) grpc.UnaryServerInterceptor {
+	i := newRPCInterceptor(opts)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		call := startGRPC(ctx, i, info.FullMethod)
+		defer func() {
+			servePanic := recover()
+			if servePanic != nil && i.recover {
+				err = errGRPCPanic
+			}
+			sent := int64(0)
+			if err == nil && servePanic == nil {
+				sent = 1
+			}
+			finishGRPC(i, call, servePanic, err, 1, sent)
+		}()
+		return handler(call.ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a [grpc.StreamServerInterceptor] that logs
+// requests in the same way as UnaryServerInterceptor, with the number of
+// messages received and sent over the stream.
+func StreamServerInterceptor(opts ...Option) grpc.StreamServerInterceptor {
+	i := newRPCInterceptor(opts)
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		call := startGRPC(ss.Context(), i, info.FullMethod)
+		stream := &loggedServerStream{ServerStream: ss, ctx: call.ctx}
+		defer func() {
+			servePanic := recover()
+			if servePanic != nil && i.recover {
+				err = errGRPCPanic
+			}
+			finishGRPC(i, call, servePanic, err, stream.received.Load(), stream.sent.Load())
+		}()
+		return handler(srv, stream)
+	}
+}
+
+var errGRPCPanic = status.Error(codes.Internal, "internal error")
+
+func startGRPC(ctx context.Context, i *rpcInterceptor, fullMethod string) *rpcCall {
+	md, _ := metadata.FromIncomingContext(ctx)
+	reqAttrs := []any{
+		slog.String("requestMethod", http.MethodPost),
+		slog.String("requestUrl", fullMethod),
+		slog.String("protocol", "HTTP/2"),
+	}
+	if ua := firstMetadata(md, "user-agent"); ua != "" {
+		reqAttrs = append(reqAttrs, slog.String("userAgent", ua))
+	}
+
+	call := i.start(ctx, fullMethod, peerIP(ctx), firstMetadata(md, i.requestIDHeader), reqAttrs)
+	if id := call.state.requestID; id != "" {
+		_ = grpc.SetHeader(call.ctx, metadata.Pairs(i.requestIDHeader, id))
+	}
+	return call
+}
+
+func finishGRPC(i *rpcInterceptor, call *rpcCall, servePanic any, err error, received int64, sent int64) {
+	code := status.Code(err)
+	if servePanic != nil {
+		// Whether recovered or propagated to the server, the client receives
+		// an internal error.
+		code = codes.Internal
+	}
+	service, method := splitFullMethod(call.route)
+	i.finish(call, servePanic, grpcHTTPStatus(code), slog.Group("grpc",
+		slog.String("service", service),
+		slog.String("method", method),
+		slog.String("code", code.String()),
+		slog.Int64("messagesReceived", received),
+		slog.Int64("messagesSent", sent),
+	))
+}
+
+// loggedServerStream is a grpc.ServerStream that counts messages and
+// provides the context for the handler.
+type loggedServerStream struct {
+	grpc.ServerStream
+
+	ctx      context.Context
+	received atomic.Int64
+	sent     atomic.Int64
+}
+
+func (s *loggedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *loggedServerStream) SendMsg(m any) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err //nolint:wrapcheck // pass through stream errors
+	}
+	s.sent.Add(1)
+	return nil
+}
+
+func (s *loggedServerStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err //nolint:wrapcheck // pass through stream errors like io.EOF
+	}
+	s.received.Add(1)
+	return nil
+}
+
+// grpcHTTPStatus returns the HTTP status closest to a gRPC status code,
+// following the mapping of google.rpc.Code.
+func grpcHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return statusClientClosedRequest
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Unknown, codes.Internal, codes.DataLoss:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// splitFullMethod splits a gRPC method name of the form /package.Service/Method.
+func splitFullMethod(fullMethod string) (string, string) {
+	service, method, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return "", fullMethod
+	}
+	return service, method
+}
+
+// peerIP returns the IP address of the peer of the call, without the port.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	if tcp, ok := p.Addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return addrIP(p.Addr.String())
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	if key == "" {
+		return ""
+	}
+	if vals := md.Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
@@ -0,0 +1,206 @@
+package requestlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type grpcRecord struct {
+	gcpRecord
+
+	GRPC struct {
+		Service          string `json:"service"`
+		Method           string `json:"method"`
+		Code             string `json:"code"`
+		MessagesReceived int    `json:"messagesReceived"`
+		MessagesSent     int    `json:"messagesSent"`
+	} `json:"grpc"`
+	RequestID string `json:"requestId"`
+}
+
+// syncBuffer is a bytes.Buffer safe for logging from server goroutines while
+// being read by the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func TestGRPCInterceptors(t *testing.T) {
+	var output syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+	opts := []Option{Logger(logger), RequestID("")}
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(opts...)),
+		grpc.StreamInterceptor(StreamServerInterceptor(opts...)),
+	)
+	hs := health.NewServer()
+	hs.SetServingStatus("bear", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, hs)
+
+	lis := bufconn.Listen(1 << 20)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUserAgent("curioswitch"),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	t.Run("unary", func(t *testing.T) {
+		output.Reset()
+
+		var header metadata.MD
+		ctx := metadata.AppendToOutgoingContext(t.Context(), "x-request-id", "abcd-1234")
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "bear"}, grpc.Header(&header))
+		require.NoError(t, err)
+		require.Equal(t, []string{"abcd-1234"}, header.Get("x-request-id"))
+
+		var rec grpcRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "INFO", rec.Level)
+		require.Equal(t, "Server Request", rec.Message)
+		require.Equal(t, http.MethodPost, rec.HTTPRequest.RequestMethod)
+		require.Equal(t, "/grpc.health.v1.Health/Check", rec.HTTPRequest.RequestURL)
+		require.Equal(t, "HTTP/2", rec.HTTPRequest.Protocol)
+		require.Equal(t, http.StatusOK, rec.HTTPRequest.Status)
+		require.True(t, strings.HasPrefix(rec.HTTPRequest.UserAgent, "curioswitch"))
+		require.Equal(t, "grpc.health.v1.Health", rec.GRPC.Service)
+		require.Equal(t, "Check", rec.GRPC.Method)
+		require.Equal(t, "OK", rec.GRPC.Code)
+		require.Equal(t, 1, rec.GRPC.MessagesReceived)
+		require.Equal(t, 1, rec.GRPC.MessagesSent)
+		require.Equal(t, "abcd-1234", rec.RequestID)
+		require.Equal(t, "/grpc.health.v1.Health/Check", rec.Route)
+	})
+
+	t.Run("unary error", func(t *testing.T) {
+		output.Reset()
+
+		_, err := client.Check(t.Context(), &healthpb.HealthCheckRequest{Service: "cat"})
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		var rec grpcRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "WARN", rec.Level)
+		require.Equal(t, http.StatusNotFound, rec.HTTPRequest.Status)
+		require.Equal(t, "NotFound", rec.GRPC.Code)
+		require.Equal(t, 1, rec.GRPC.MessagesReceived)
+		require.Equal(t, 0, rec.GRPC.MessagesSent)
+		require.NotEmpty(t, rec.RequestID)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		output.Reset()
+
+		ctx, cancel := context.WithCancel(t.Context())
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "bear"})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.NoError(t, err)
+		cancel()
+
+		require.Eventually(t, func() bool {
+			return len(output.Bytes()) > 0
+		}, 5*time.Second, 10*time.Millisecond)
+		var rec grpcRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "Watch", rec.GRPC.Method)
+		require.Equal(t, "Canceled", rec.GRPC.Code)
+		require.Equal(t, 499, rec.HTTPRequest.Status)
+		require.Equal(t, 1, rec.GRPC.MessagesReceived)
+		require.Equal(t, 1, rec.GRPC.MessagesSent)
+	})
+}
+
+func TestGRPCInterceptorPanic(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/zoo.Animals/GetBear"}
+	handler := func(ctx context.Context, _ any) (any, error) {
+		AddExtraAttr(ctx, slog.String("animal", "bear"))
+		panic("failure")
+	}
+
+	t.Run("recover", func(t *testing.T) {
+		var output bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+		interceptor := UnaryServerInterceptor(Logger(logger), Recover(nil))
+
+		_, err := interceptor(t.Context(), nil, info, handler)
+		require.Equal(t, codes.Internal, status.Code(err))
+
+		var rec grpcRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "ERROR", rec.Level)
+		require.Equal(t, "panic: failure", rec.Message)
+		require.Equal(t, reportedErrorEventType, rec.Type)
+		require.Equal(t, http.StatusInternalServerError, rec.HTTPRequest.Status)
+		require.Equal(t, "bear", rec.Animal)
+		require.Contains(t, rec.StackTrace, "panic: failure\n\ngoroutine ")
+		require.Equal(t, "Internal", rec.GRPC.Code)
+		require.Equal(t, 1, rec.GRPC.MessagesReceived)
+		require.Zero(t, rec.GRPC.MessagesSent)
+	})
+
+	t.Run("propagate", func(t *testing.T) {
+		var output bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+		interceptor := UnaryServerInterceptor(Logger(logger))
+
+		require.PanicsWithValue(t, "failure", func() {
+			_, _ = interceptor(t.Context(), nil, info, handler)
+		})
+
+		var rec grpcRecord
+		require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+		require.Equal(t, "ERROR", rec.Level)
+		require.Equal(t, "panic: failure", rec.Message)
+		require.Equal(t, http.StatusInternalServerError, rec.HTTPRequest.Status)
+		require.Equal(t, "Internal", rec.GRPC.Code)
+		require.Equal(t, 1, rec.GRPC.MessagesReceived)
+		require.Zero(t, rec.GRPC.MessagesSent)
+	})
+}
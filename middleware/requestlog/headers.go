@@ -0,0 +1,171 @@
+package requestlog
+
+import (
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// maskedHeaders are headers containing credentials, whose values are never
+// logged.
+var maskedHeaders = map[string]bool{
+	"Authorization":            true,
+	"Cookie":                   true,
+	"Proxy-Authorization":      true,
+	"Set-Cookie":               true,
+	"X-Api-Key":                true,
+	"X-Goog-Api-Key":           true,
+	"X-Goog-Iap-Jwt-Assertion": true,
+}
+
+const maskedHeaderValue = "[REDACTED]"
+
+// RequestHeaders returns an Option to record the request headers with the
+// given names in the request log, as httpHeaders.request. A name ending in
+// "*" matches any header with that prefix, for example "X-Goog-*". Each
+// header is recorded as a list of all its values. Values of headers containing
+// credentials, such as Authorization, Cookie and X-Goog-Api-Key, are masked,
+// as are ones configured with MaskHeaders, and other values can be redacted
+// with RedactHeaders.
+func RequestHeaders(names ...string) Option {
+	return requestHeadersOption{matcher: newHeaderMatcher(names)}
+}
+
+type requestHeadersOption struct {
+	matcher *headerMatcher
+}
+
+func (o requestHeadersOption) apply(conf *config) {
+	conf.requestHeaders = o.matcher
+}
+
+// ResponseHeaders returns an Option to record the response headers with the
+// given names in the request log, as httpHeaders.response. Names are matched
+// and values are recorded in the same way as RequestHeaders.
+func ResponseHeaders(names ...string) Option {
+	return responseHeadersOption{matcher: newHeaderMatcher(names)}
+}
+
+type responseHeadersOption struct {
+	matcher *headerMatcher
+}
+
+func (o responseHeadersOption) apply(conf *config) {
+	conf.responseHeaders = o.matcher
+}
+
+// MaskHeaders returns an Option to mask the values of the headers with the
+// given names in the request log, in addition to the default headers
+// containing credentials. Names are matched in the same way as
+// RequestHeaders, so "X-Secret-*" masks any header with that prefix.
+func MaskHeaders(names ...string) Option {
+	return maskHeadersOption{matcher: newHeaderMatcher(names)}
+}
+
+type maskHeadersOption struct {
+	matcher *headerMatcher
+}
+
+func (o maskHeadersOption) apply(conf *config) {
+	conf.maskedHeaders = o.matcher
+}
+
+// RedactHeaders returns an Option to redact the values of headers recorded in
+// the request log. redact is called with the canonical name and each value of
+// headers that are not masked, and the returned value is logged instead.
+func RedactHeaders(redact func(name string, value string) string) Option {
+	return redactHeadersOption(redact)
+}
+
+type redactHeadersOption func(name string, value string) string
+
+func (o redactHeadersOption) apply(conf *config) {
+	conf.redactHeader = o
+}
+
+// appendHeaders appends the httpHeaders group for the configured headers of
+// a request and its response to logArgs.
+func (c *config) appendHeaders(logArgs []any, reqHeader http.Header, resHeader http.Header) []any {
+	var attrs []any
+	if c.requestHeaders != nil {
+		attrs = append(attrs, c.headersAttr(c.requestHeaders, "request", reqHeader))
+	}
+	if c.responseHeaders != nil {
+		attrs = append(attrs, c.headersAttr(c.responseHeaders, "response", resHeader))
+	}
+	if len(attrs) == 0 {
+		return logArgs
+	}
+	return append(logArgs, slog.Group("httpHeaders", attrs...))
+}
+
+// headerMatcher matches header names against exact names and prefixes.
+type headerMatcher struct {
+	names    map[string]bool
+	prefixes []string
+}
+
+func newHeaderMatcher(names []string) *headerMatcher {
+	m := &headerMatcher{names: map[string]bool{}}
+	for _, name := range names {
+		if prefix, ok := strings.CutSuffix(name, "*"); ok {
+			m.prefixes = append(m.prefixes, strings.ToLower(prefix))
+		} else {
+			m.names[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return m
+}
+
+func (m *headerMatcher) match(name string) bool {
+	if m.names[name] {
+		return true
+	}
+	if len(m.prefixes) == 0 {
+		return false
+	}
+	lower := strings.ToLower(name)
+	for _, p := range m.prefixes {
+		if strings.HasPrefix(lower, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersAttr returns the attribute for the headers in h matched by m, or an
+// empty attribute if there are none.
+func (c *config) headersAttr(m *headerMatcher, key string, h http.Header) slog.Attr {
+	var attrs []slog.Attr
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		if !m.match(name) {
+			continue
+		}
+		values := h[name]
+		switch {
+		case c.isMaskedHeader(name):
+			masked := make([]string, len(values))
+			for i := range masked {
+				masked[i] = maskedHeaderValue
+			}
+			values = masked
+		case c.redactHeader != nil:
+			redacted := make([]string, len(values))
+			for i, v := range values {
+				redacted[i] = c.redactHeader(name, v)
+			}
+			values = redacted
+		}
+		attrs = append(attrs, slog.Any(name, values))
+	}
+	if len(attrs) == 0 {
+		return slog.Attr{}
+	}
+	return slog.Attr{Key: key, Value: slog.GroupValue(attrs...)}
+}
+
+func (c *config) isMaskedHeader(name string) bool {
+	return maskedHeaders[name] || (c.maskedHeaders != nil && c.maskedHeaders.match(name))
+}
@@ -0,0 +1,129 @@
+package requestlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaders(t *testing.T) {
+	type headersRecord struct {
+		Request  map[string][]string `json:"request"`
+		Response map[string][]string `json:"response"`
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+
+		headers *headersRecord
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name: "request",
+			opts: []Option{RequestHeaders("content-type", "Accept-Language", "X-Goog-*", "Authorization", "Cookie")},
+			headers: &headersRecord{
+				Request: map[string][]string{
+					"Content-Type":              {"application/json"},
+					"Accept-Language":           {"ja", "en"},
+					"X-Goog-Authenticated-User": {"bear@example.com"},
+					"X-Goog-Iap-Jwt-Assertion":  {"[REDACTED]"},
+					"X-Goog-Api-Key":            {"[REDACTED]"},
+					"Authorization":             {"[REDACTED]"},
+					"Cookie":                    {"[REDACTED]", "[REDACTED]"},
+				},
+			},
+		},
+		{
+			name: "masked",
+			opts: []Option{
+				RequestHeaders("X-Goog-*", "X-Api-Key", "Accept-Language"),
+				MaskHeaders("x-goog-authenticated-*", "Accept-Language"),
+			},
+			headers: &headersRecord{
+				Request: map[string][]string{
+					"Accept-Language":           {"[REDACTED]", "[REDACTED]"},
+					"X-Goog-Authenticated-User": {"[REDACTED]"},
+					"X-Goog-Iap-Jwt-Assertion":  {"[REDACTED]"},
+					"X-Goog-Api-Key":            {"[REDACTED]"},
+					"X-Api-Key":                 {"[REDACTED]"},
+				},
+			},
+		},
+		{
+			name: "redacted",
+			opts: []Option{
+				RequestHeaders("X-Goog-*", "Accept-Language"),
+				RedactHeaders(func(name string, value string) string {
+					if name == "X-Goog-Authenticated-User" {
+						return strings.Repeat("*", len(value))
+					}
+					return value
+				}),
+			},
+			headers: &headersRecord{
+				Request: map[string][]string{
+					"Accept-Language":           {"ja", "en"},
+					"X-Goog-Authenticated-User": {"****************"},
+					"X-Goog-Iap-Jwt-Assertion":  {"[REDACTED]"},
+					"X-Goog-Api-Key":            {"[REDACTED]"},
+				},
+			},
+		},
+		{
+			name: "response",
+			opts: []Option{ResponseHeaders("Content-Type", "Set-Cookie", "X-Missing")},
+			headers: &headersRecord{
+				Response: map[string][]string{
+					"Content-Type": {"text/plain"},
+					"Set-Cookie":   {"[REDACTED]"},
+				},
+			},
+		},
+		{
+			name: "none matched",
+			opts: []Option{RequestHeaders("X-Missing"), ResponseHeaders("X-Missing")},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+			h := NewMiddleware(append([]Option{Logger(logger)}, tc.opts...)...)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Set-Cookie", "session=secret")
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Add("Accept-Language", "ja")
+			req.Header.Add("Accept-Language", "en")
+			req.Header.Set("X-Goog-Authenticated-User", "bear@example.com")
+			req.Header.Set("X-Goog-Iap-Jwt-Assertion", "token")
+			req.Header.Set("X-Goog-Api-Key", "key")
+			req.Header.Set("X-Api-Key", "key")
+			req.Header.Set("Authorization", "Bearer secret")
+			req.Header.Add("Cookie", "a=1")
+			req.Header.Add("Cookie", "b=2")
+			req.Header.Set("User-Agent", "curioswitch")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			var rec struct {
+				Headers *headersRecord `json:"httpHeaders"`
+			}
+			require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+			require.Equal(t, tc.headers, rec.Headers)
+		})
+	}
+}
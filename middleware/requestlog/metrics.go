@@ -0,0 +1,171 @@
+package requestlog
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// scopeName is the instrumentation scope of metrics and spans.
+const scopeName = "github.com/curioswitch/go-usegcp/middleware/requestlog"
+
+// MeterProvider returns an Option to record OpenTelemetry HTTP server metrics
+// for requests using mp, following the semantic conventions. The
+// http.server.request.duration, http.server.request.body.size and
+// http.server.response.body.size histograms are recorded with the method,
+// status if one was sent, scheme, protocol version, and route of the request,
+// which is the pattern of the [http.ServeMux] or the one recorded by
+// NamedHandler.
+// Panics, cancellations and server errors are recorded as error.type, as the
+// status of the request log may differ from the one sent for them. The
+// http.server.active_requests counter is recorded with the method and scheme.
+// Metrics are recorded for all requests, including ones not logged because of
+// Skip or Sample.
+func MeterProvider(mp metric.MeterProvider) Option {
+	return meterProviderOption{mp: mp}
+}
+
+type meterProviderOption struct {
+	mp metric.MeterProvider
+}
+
+func (o meterProviderOption) apply(conf *config) {
+	conf.meterProvider = o.mp
+}
+
+// serverMetrics are the instruments for HTTP server metrics.
+type serverMetrics struct {
+	duration     metric.Float64Histogram
+	activeReqs   metric.Int64UpDownCounter
+	requestSize  metric.Int64Histogram
+	responseSize metric.Int64Histogram
+}
+
+func newServerMetrics(mp metric.MeterProvider) *serverMetrics {
+	meter := mp.Meter(scopeName)
+
+	duration, err := meter.Float64Histogram("http.server.request.duration",
+		metric.WithDescription("Duration of HTTP server requests."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	activeReqs, err := meter.Int64UpDownCounter("http.server.active_requests",
+		metric.WithDescription("Number of active HTTP server requests."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	requestSize, err := meter.Int64Histogram("http.server.request.body.size",
+		metric.WithDescription("Size of HTTP server request bodies."),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	responseSize, err := meter.Int64Histogram("http.server.response.body.size",
+		metric.WithDescription("Size of HTTP server response bodies."),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+
+	return &serverMetrics{
+		duration:     duration,
+		activeReqs:   activeReqs,
+		requestSize:  requestSize,
+		responseSize: responseSize,
+	}
+}
+
+// start records the start of req, returning the attributes common to all
+// its metrics.
+func (m *serverMetrics) start(ctx context.Context, req *http.Request) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", metricMethod(req.Method)),
+		attribute.String("url.scheme", urlScheme(req)),
+	}
+	m.activeReqs.Add(ctx, 1, metric.WithAttributes(attrs...))
+	return attrs
+}
+
+// finish records the completion of req, started with start. code is the
+// status code sent, if statusSent, and errType is the error.type of the
+// request, if any.
+func (m *serverMetrics) finish(ctx context.Context, req *http.Request, attrs []attribute.KeyValue, route string, code int, statusSent bool, errType string, duration time.Duration, reqSize int64, resSize int64) {
+	m.activeReqs.Add(ctx, -1, metric.WithAttributes(attrs...))
+
+	attrs = append(attrs,
+		attribute.String("network.protocol.name", "http"),
+		attribute.String("network.protocol.version", protocolVersion(req)),
+	)
+	if statusSent {
+		attrs = append(attrs, attribute.Int("http.response.status_code", code))
+	}
+	if route != "" {
+		attrs = append(attrs, attribute.String("http.route", route))
+	}
+	if errType != "" {
+		attrs = append(attrs, attribute.String("error.type", errType))
+	}
+	set := metric.WithAttributeSet(attribute.NewSet(attrs...))
+	m.duration.Record(ctx, duration.Seconds(), set)
+	m.requestSize.Record(ctx, reqSize, set)
+	m.responseSize.Record(ctx, resSize, set)
+}
+
+// errorType returns the error.type of a request that sent the status code,
+// identifying a panic or cancellation of the handler, which the status code
+// may not reflect, or otherwise the status code if it is a server error.
+func errorType(servePanic any, cancel *cancellation, code int) string {
+	switch {
+	case servePanic != nil:
+		return "panic"
+	case cancel != nil && cancel.reason == cancelReasonTimeout:
+		return "timeout"
+	case cancel != nil:
+		return "canceled"
+	case code >= 500:
+		return strconv.Itoa(code)
+	default:
+		return ""
+	}
+}
+
+// metricMethod returns method if it is a known method, or _OTHER to avoid
+// unbounded cardinality.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodConnect, http.MethodDelete, http.MethodGet, http.MethodHead,
+		http.MethodOptions, http.MethodPatch, http.MethodPost, http.MethodPut,
+		http.MethodTrace:
+		return method
+	default:
+		return "_OTHER"
+	}
+}
+
+func urlScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func protocolVersion(req *http.Request) string {
+	switch {
+	case req.ProtoMajor == 1:
+		return "1." + strconv.Itoa(req.ProtoMinor)
+	default:
+		return strconv.Itoa(req.ProtoMajor)
+	}
+}
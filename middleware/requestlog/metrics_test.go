@@ -0,0 +1,217 @@
+package requestlog
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		method string
+		path   string
+
+		status  int
+		route   string
+		errType string
+		panics  any
+		// noStatus is whether no status was sent to the client.
+		noStatus bool
+	}{
+		{
+			name:   "pattern",
+			method: http.MethodPost,
+			path:   "/users/1",
+			status: http.StatusOK,
+			route:  "POST /users/{id}",
+		},
+		{
+			name:   "named handler",
+			method: http.MethodPost,
+			path:   "/items/1",
+			status: http.StatusCreated,
+			route:  "POST /items/{id}",
+		},
+		{
+			name:   "not found",
+			method: http.MethodPost,
+			path:   "/bears/1",
+			status: http.StatusNotFound,
+		},
+		{
+			name:    "server error",
+			method:  http.MethodPost,
+			path:    "/error",
+			status:  http.StatusBadGateway,
+			route:   "POST /error",
+			errType: "502",
+		},
+		{
+			name:    "panic after response",
+			opts:    []Option{Recover(nil)},
+			method:  http.MethodPost,
+			path:    "/panic",
+			status:  http.StatusOK,
+			route:   "POST /panic",
+			errType: "panic",
+			panics:  http.ErrAbortHandler,
+		},
+		{
+			name:     "panic before response",
+			method:   http.MethodPost,
+			path:     "/panic-early",
+			status:   http.StatusOK,
+			route:    "POST /panic-early",
+			errType:  "panic",
+			panics:   "oops",
+			noStatus: true,
+		},
+		{
+			name:    "canceled",
+			method:  http.MethodPost,
+			path:    "/cancel",
+			status:  http.StatusOK,
+			route:   "POST /cancel",
+			errType: "canceled",
+		},
+		{
+			name:   "skipped",
+			opts:   []Option{Skip(func(*http.Request) bool { return true })},
+			method: http.MethodPost,
+			path:   "/users/1",
+			status: http.StatusOK,
+			route:  "POST /users/{id}",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := sdkmetric.NewManualReader()
+			mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /users/{id}", func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.Copy(io.Discard, req.Body)
+				_, _ = w.Write([]byte("hello"))
+			})
+			mux.Handle("POST /items/{id}", NamedHandler("CreateItem", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.Copy(io.Discard, req.Body)
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte("hello"))
+			})))
+
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			mux.HandleFunc("POST /error", func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.Copy(io.Discard, req.Body)
+				w.WriteHeader(http.StatusBadGateway)
+			})
+			mux.HandleFunc("POST /panic", func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.Copy(io.Discard, req.Body)
+				_, _ = w.Write([]byte("hello"))
+				panic("oops")
+			})
+			mux.HandleFunc("POST /panic-early", func(_ http.ResponseWriter, req *http.Request) {
+				_, _ = io.Copy(io.Discard, req.Body)
+				panic("oops")
+			})
+			mux.HandleFunc("POST /cancel", func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.Copy(io.Discard, req.Body)
+				_, _ = w.Write([]byte("hello"))
+				cancel()
+			})
+
+			var out bytes.Buffer
+			opts := append([]Option{Logger(slog.New(slog.NewJSONHandler(&out, nil))), MeterProvider(mp)}, tc.opts...)
+			h := NewMiddleware(opts...)(mux)
+
+			req := httptest.NewRequestWithContext(ctx, tc.method, tc.path, strings.NewReader("body"))
+			res := httptest.NewRecorder()
+			if tc.panics != nil {
+				require.PanicsWithValue(t, tc.panics, func() {
+					h.ServeHTTP(res, req)
+				})
+			} else {
+				h.ServeHTTP(res, req)
+			}
+			require.Equal(t, tc.status, res.Code)
+
+			var rm metricdata.ResourceMetrics
+			require.NoError(t, reader.Collect(t.Context(), &rm))
+			require.Len(t, rm.ScopeMetrics, 1)
+			require.Equal(t, scopeName, rm.ScopeMetrics[0].Scope.Name)
+
+			metrics := map[string]metricdata.Metrics{}
+			for _, m := range rm.ScopeMetrics[0].Metrics {
+				metrics[m.Name] = m
+			}
+
+			attrs := []attribute.KeyValue{
+				attribute.String("http.request.method", tc.method),
+				attribute.String("network.protocol.name", "http"),
+				attribute.String("network.protocol.version", "1.1"),
+				attribute.String("url.scheme", "http"),
+			}
+			if !tc.noStatus {
+				attrs = append(attrs, attribute.Int("http.response.status_code", tc.status))
+			}
+			if tc.route != "" {
+				attrs = append(attrs, attribute.String("http.route", tc.route))
+			}
+			if tc.errType != "" {
+				attrs = append(attrs, attribute.String("error.type", tc.errType))
+			}
+			set := attribute.NewSet(attrs...)
+
+			duration := metrics["http.server.request.duration"].Data.(metricdata.Histogram[float64])
+			require.Len(t, duration.DataPoints, 1)
+			require.Equal(t, set, duration.DataPoints[0].Attributes)
+			require.Equal(t, uint64(1), duration.DataPoints[0].Count)
+
+			sizes := map[string]int64{
+				"http.server.request.body.size":  0,
+				"http.server.response.body.size": 0,
+			}
+			switch {
+			case tc.route == "":
+				sizes["http.server.response.body.size"] = int64(len("404 page not found\n"))
+			case tc.status == http.StatusBadGateway || tc.noStatus:
+				sizes["http.server.request.body.size"] = 4
+			default:
+				sizes["http.server.request.body.size"] = 4
+				sizes["http.server.response.body.size"] = 5
+			}
+			for name, size := range sizes {
+				hist := metrics[name].Data.(metricdata.Histogram[int64])
+				require.Len(t, hist.DataPoints, 1, name)
+				require.Equal(t, set, hist.DataPoints[0].Attributes, name)
+				require.Equal(t, size, hist.DataPoints[0].Sum, name)
+			}
+
+			active := metrics["http.server.active_requests"].Data.(metricdata.Sum[int64])
+			require.Len(t, active.DataPoints, 1)
+			require.Equal(t, attribute.NewSet(
+				attribute.String("http.request.method", tc.method),
+				attribute.String("url.scheme", "http"),
+			), active.DataPoints[0].Attributes)
+			require.Equal(t, int64(0), active.DataPoints[0].Value)
+		})
+	}
+}
+
+func TestMetricMethod(t *testing.T) {
+	require.Equal(t, http.MethodGet, metricMethod(http.MethodGet))
+	require.Equal(t, "_OTHER", metricMethod("PROPFIND"))
+}
@@ -0,0 +1,121 @@
+package requestlog
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ParentRequestLog returns an Option to write request logs to logger as
+// parents of the logs of the handler. Cloud Logging displays logs nested under
+// a request log when they have the same trace and are in a different log, so
+// logger must write to a separate log from the one the handler logs to, for
+// example with a [slog.Handler] writing entries to the Cloud Logging API with
+// the log name request_log, like App Engine. All logs written to stdout on
+// Cloud Run or GKE are in the same log, so writing both there does not nest
+// them.
+//
+// If the request has no span context, one is read from the traceparent or
+// X-Cloud-Trace-Context header or generated, so logs using the request's
+// context always have a trace. When the logger of the handler uses a handler
+// wrapped with ChildHandler, the level of the request log is raised to the
+// highest level logged by the handler, like the severity of App Engine's
+// request logs. Other logs of the middleware, such as in-flight warnings,
+// continue to be written to the logger set with Logger.
+func ParentRequestLog(logger *slog.Logger) Option {
+	return parentRequestLogOption{logger: logger}
+}
+
+type parentRequestLogOption struct {
+	logger *slog.Logger
+}
+
+func (o parentRequestLogOption) apply(conf *config) {
+	conf.parentLogger = o.logger
+}
+
+// ChildHandler returns a [slog.Handler] that records the level of logs with
+// the context of a request to the requestlog middleware before passing them
+// to h, for the level of the request log written with ParentRequestLog.
+func ChildHandler(h slog.Handler) slog.Handler {
+	return childHandler{next: h}
+}
+
+type childHandler struct {
+	next slog.Handler
+}
+
+// Enabled implements slog.Handler.
+func (h childHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.next.Enabled(ctx, l)
+}
+
+// Handle implements slog.Handler.
+func (h childHandler) Handle(ctx context.Context, r slog.Record) error {
+	if s := stateFromContext(ctx); s != nil {
+		s.mu.Lock()
+		if !s.childLogged || r.Level > s.childLevel {
+			s.childLogged = true
+			s.childLevel = r.Level
+		}
+		s.mu.Unlock()
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h childHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return childHandler{next: h.next.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler.
+func (h childHandler) WithGroup(name string) slog.Handler {
+	return childHandler{next: h.next.WithGroup(name)}
+}
+
+// withoutRequestState returns ctx without the state of the request, for logs
+// of the middleware itself which must not be recorded as logs of the handler
+// by ChildHandler.
+func withoutRequestState(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestStateContextKey, (*requestState)(nil))
+}
+
+// requestLogger returns the logger for request logs.
+func (c *config) requestLogger() *slog.Logger {
+	if c.parentLogger != nil {
+		return c.parentLogger
+	}
+	return c.getLogger()
+}
+
+// maxChildLevel returns the highest level logged by the handler through
+// ChildHandler, if any.
+func (s *requestState) maxChildLevel() (slog.Level, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.childLevel, s.childLogged
+}
+
+// ensureSpanContext returns ctx with a span context, propagated from header
+// or generated if there is none, so logs of the request are grouped by trace.
+func ensureSpanContext(ctx context.Context, header http.Header) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	ctx = extractTraceContext(ctx, header)
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	_, _ = rand.Read(traceID[:])
+	_, _ = rand.Read(spanID[:])
+	return trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+}
@@ -0,0 +1,168 @@
+package requestlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/curioswitch/go-usegcp/gcpslog"
+)
+
+func TestParentRequestLog(t *testing.T) {
+	type logRecord struct {
+		Severity string `json:"severity"`
+		Message  string `json:"message"`
+		Trace    string `json:"logging.googleapis.com/trace"`
+		SpanID   string `json:"logging.googleapis.com/spanId"`
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		levels []slog.Level
+		status int
+
+		severity string
+		trace    string
+	}{
+		{
+			name:     "no child logs",
+			status:   http.StatusOK,
+			severity: "INFO",
+		},
+		{
+			name:     "child logs",
+			levels:   []slog.Level{slog.LevelInfo, slog.LevelWarn, slog.LevelDebug},
+			status:   http.StatusOK,
+			severity: "WARNING",
+		},
+		{
+			name:     "status higher than children",
+			levels:   []slog.Level{slog.LevelWarn},
+			status:   http.StatusInternalServerError,
+			severity: "ERROR",
+		},
+		{
+			name:     "error child",
+			levels:   []slog.Level{slog.LevelError},
+			status:   http.StatusOK,
+			severity: "ERROR",
+		},
+		{
+			name:     "traceparent",
+			header:   http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}},
+			levels:   []slog.Level{slog.LevelInfo},
+			status:   http.StatusOK,
+			severity: "INFO",
+			trace:    "0af7651916cd43dd8448eb211c80319c",
+		},
+		{
+			name:     "cloud trace context",
+			header:   http.Header{"X-Cloud-Trace-Context": {"105445aa7843bc8bf206b12000100000/1;o=1"}},
+			levels:   []slog.Level{slog.LevelInfo},
+			status:   http.StatusOK,
+			severity: "INFO",
+			trace:    "105445aa7843bc8bf206b12000100000",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var reqOut, appOut bytes.Buffer
+			appLogger := slog.New(ChildHandler(gcpslog.NewHandler(&appOut, gcpslog.Level(slog.LevelDebug))))
+
+			h := NewMiddleware(
+				Logger(appLogger),
+				ParentRequestLog(slog.New(gcpslog.NewHandler(&reqOut))),
+			)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				for _, l := range tc.levels {
+					appLogger.Log(req.Context(), l, "app")
+				}
+				w.WriteHeader(tc.status)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			var reqLog logRecord
+			require.NoError(t, json.Unmarshal(reqOut.Bytes(), &reqLog))
+			require.Equal(t, "Server Request", reqLog.Message)
+			require.Equal(t, tc.severity, reqLog.Severity)
+			require.NotEmpty(t, reqLog.Trace)
+			if tc.trace != "" {
+				require.True(t, strings.HasSuffix(reqLog.Trace, "/traces/"+tc.trace), reqLog.Trace)
+			}
+
+			lines := strings.Split(strings.TrimSpace(appOut.String()), "\n")
+			if len(tc.levels) == 0 {
+				require.Empty(t, appOut.String())
+				return
+			}
+			require.Len(t, lines, len(tc.levels))
+			for _, line := range lines {
+				var appLog logRecord
+				require.NoError(t, json.Unmarshal([]byte(line), &appLog))
+				require.Equal(t, "app", appLog.Message)
+				require.Equal(t, reqLog.Trace, appLog.Trace)
+				require.Equal(t, reqLog.SpanID, appLog.SpanID)
+			}
+		})
+	}
+}
+
+func TestParentRequestLogInFlightWarning(t *testing.T) {
+	var reqOut bytes.Buffer
+	var appOut syncBuffer
+	warned := make(chan struct{})
+	appLogger := slog.New(ChildHandler(gcpslog.NewHandler(writerFunc(func(p []byte) (int, error) {
+		n, err := appOut.Write(p)
+		if bytes.Contains(p, []byte("Request still in flight")) {
+			close(warned)
+		}
+		return n, err
+	}))))
+
+	h := NewMiddleware(
+		Logger(appLogger),
+		ParentRequestLog(slog.New(gcpslog.NewHandler(&reqOut))),
+		InFlightWarning(time.Millisecond),
+	)(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		<-warned
+		appLogger.InfoContext(req.Context(), "app")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// The warning of the middleware is not a log of the handler, so it
+	// doesn't raise the level of the request log.
+	var reqLog map[string]any
+	require.NoError(t, json.Unmarshal(reqOut.Bytes(), &reqLog))
+	require.Equal(t, "Server Request", reqLog["message"])
+	require.Equal(t, "INFO", reqLog["severity"])
+
+	lines := strings.Split(strings.TrimSpace(string(appOut.Bytes())), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], "Request still in flight")
+	require.Contains(t, lines[1], `"message":"app"`)
+}
+
+func TestChildHandlerWithoutRequest(t *testing.T) {
+	var out bytes.Buffer
+	l := slog.New(ChildHandler(gcpslog.NewHandler(&out))).With("a", 1).WithGroup("g")
+	l.Info("hello", "b", 2)
+
+	var log map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &log))
+	require.Equal(t, "hello", log["message"])
+	require.InDelta(t, 1, log["a"], 0)
+	require.Equal(t, map[string]any{"b": float64(2)}, log["g"])
+}
@@ -0,0 +1,68 @@
+package requestlog
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+)
+
+// DefaultRequestIDHeader is the header used for request IDs if not specified
+// with RequestID.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// The maximum length of a request ID read from a request, longer ones are
+// replaced with a generated ID.
+const maxRequestIDLength = 128
+
+// RequestID returns an Option to identify each request with an ID, read from
+// header of the request or generated if it is missing or malformed. If header
+// is empty, DefaultRequestIDHeader is used. The ID is returned in the same
+// header of the response, recorded as the requestId attribute of the request
+// log, and can be read by handlers with RequestIDFromContext. When using a
+// handler from [github.com/curioswitch/go-usegcp/gcpslog], it is also
+// recorded with every log using the request's context.
+func RequestID(header string) Option {
+	if header == "" {
+		header = DefaultRequestIDHeader
+	}
+	return requestIDOption(http.CanonicalHeaderKey(header))
+}
+
+type requestIDOption string
+
+func (o requestIDOption) apply(conf *config) {
+	conf.requestIDHeader = string(o)
+}
+
+// RequestIDFromContext returns the ID of the request for the given context,
+// if the requestlog middleware was configured with RequestID. Otherwise, it
+// returns an empty string.
+func RequestIDFromContext(ctx context.Context) string {
+	if s := stateFromContext(ctx); s != nil {
+		return s.requestID
+	}
+	return ""
+}
+
+// requestID returns id if it is valid, or otherwise a newly generated ID.
+func requestID(id string) string {
+	if isValidRequestID(id) {
+		return id
+	}
+	return rand.Text()
+}
+
+// isValidRequestID returns whether id is a non-empty string of printable
+// ASCII characters without spaces, which is safe to log and return in a
+// header.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := range len(id) {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
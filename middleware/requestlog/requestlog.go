@@ -1,108 +1,557 @@
 package requestlog
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/felixge/httpsnoop"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/curioswitch/go-usegcp/gcpslog"
 )
 
 // NewMiddleware returns an [http.Handler] middleware that logs requests in
 // GCP structured format using [slog]. With [slog.JSONHandler] used as the
 // handler, logs will be rendered on the GCP console with rich information
-// about the HTTP request.
+// about the HTTP request. Requests are logged at a level based on the response
+// status, see [StatusLevel].
+//
+// If the handler panics, the request is instead logged at ERROR in the format
+// recognized by Error Reporting, with the panic value and stack trace, before
+// the panic is propagated. Use [Recover] to respond to the client instead.
+//
+// If the request's context is canceled before the handler completes, the
+// request log includes a cancellation group with the reason, either client or
+// timeout, the [context.Cause], and whether the handler returned normally.
+// Requests canceled by the client are logged with status 499 since they never
+// received the response, and ones that exceed their deadline at least at
+// ERROR.
+//
+// If the handler hijacks the connection, for example for a WebSocket, the
+// upgrade is logged as its own entry when it happens, and the request log is
+// written when the connection is closed instead, with its duration and the
+// bytes read and written over it as the latency and sizes. Use
+// [StreamProgress] to log the progress of server-sent event streams.
 func NewMiddleware(opts ...Option) func(http.Handler) http.Handler {
-	var conf config
-	for _, o := range opts {
-		o.apply(&conf)
-	}
+	conf := newConfig(opts)
 
 	return func(next http.Handler) http.Handler {
-		return &handler{
+		h := &handler{
 			next:   next,
-			logger: conf.logger,
+			config: conf,
+			stacks: newStackPool(conf.maxStackSize),
+		}
+		if conf.meterProvider != nil {
+			h.metrics = newServerMetrics(conf.meterProvider)
 		}
+		if conf.tracerProvider != nil {
+			h.tracer = conf.tracerProvider.Tracer(scopeName)
+		}
+		return h
 	}
 }
 
+func newConfig(opts []Option) config {
+	conf := config{
+		maxStackSize: defaultMaxStackSize,
+		statusLevel:  defaultStatusLevel,
+		sampleRate:   1,
+	}
+	for _, o := range opts {
+		o.apply(&conf)
+	}
+	return conf
+}
+
+func newStackPool(size int) *sync.Pool {
+	return &sync.Pool{New: func() any {
+		buf := make([]byte, size)
+		return &buf
+	}}
+}
+
 type handler struct {
-	next   http.Handler
-	logger *slog.Logger
+	next http.Handler
+	config
+
+	stacks  *sync.Pool
+	metrics *serverMetrics
+	tracer  trace.Tracer
 }
 
 // ServeHTTP implements http.Handler.
 func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	metrics := httpsnoop.Metrics{Code: http.StatusOK}
 
-	var extraAttrs []any
-	ctx := context.WithValue(req.Context(), extraAttrsContextKey, &extraAttrs)
-	req = req.WithContext(ctx)
+	// Whether the response headers have been sent, after which we can't
+	// respond to a panic anymore.
+	headerWritten := false
+
+	var resCapture *responseCapture
+	if h.captureResponseLimit > 0 {
+		resCapture = &responseCapture{conf: &h.config, w: w}
+	}
+
+	reqCtx := req.Context()
+	var span trace.Span
+	if h.tracer != nil {
+		reqCtx, span = startServerSpan(reqCtx, h.tracer, req)
+		if span != nil {
+			// Deferred before logging the request so the span is ended after
+			// it. End is called indirectly so the SDK doesn't record a panic
+			// propagated by the middleware again, we record the original one
+			// with its stack.
+			defer func() { span.End() }()
+		}
+	}
+
+	if h.parentLogger != nil {
+		reqCtx = ensureSpanContext(reqCtx, req.Header)
+	}
+
+	state := &requestState{
+		clientIP: h.clientIP(req.Header, req.RemoteAddr),
+		extra:    newExtraAttrs(),
+	}
+	// The request log records the request ID itself, so we only add it to
+	// the context of the handler to avoid duplicating it.
+	ctx := context.WithValue(reqCtx, requestStateContextKey, state)
+	handlerCtx := ctx
+	if h.requestIDHeader != "" {
+		state.requestID = requestID(req.Header.Get(h.requestIDHeader))
+		w.Header().Set(h.requestIDHeader, state.requestID)
+		handlerCtx = gcpslog.ContextWithAttrs(ctx, slog.String("requestId", state.requestID))
+	}
+	req = req.WithContext(handlerCtx)
+
+	var body *countingBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &countingBody{
+			ReadCloser: req.Body,
+			capture:    h.newBodyCapture(h.captureRequestLimit, req.Header.Get("Content-Type")),
+		}
+		req.Body = body
+	}
+
+	skip := h.shouldSkip(req)
+
+	var metricAttrs []attribute.KeyValue
+	if h.metrics != nil {
+		metricAttrs = h.metrics.start(ctx, req)
+	}
+
+	// Hijacked connections are logged by the connection itself, when it is
+	// closed.
+	hijacked := false
+
+	// Event streams are tracked from when the response starts, if enabled.
+	var stream *eventStream
+	streamChecked := h.streamProgress <= 0 || skip
+	startStream := func() {
+		if streamChecked {
+			return
+		}
+		streamChecked = true
+		stream = h.startEventStream(ctx, req, w.Header())
+	}
+	w = httpsnoop.Wrap(w, httpsnoop.Hooks{
+		WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return func(code int) {
+				final := code < 100 || code > 199
+				if final {
+					startStream()
+				}
+				next(code)
+				if final {
+					headerWritten = true
+				}
+			}
+		},
+		Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(p []byte) (int, error) {
+				startStream()
+				headerWritten = true
+				n, err := next(p)
+				if resCapture != nil {
+					resCapture.write(p[:n])
+				}
+				if stream != nil {
+					stream.write(p[:n])
+				}
+				return n, err
+			}
+		},
+		WriteString: func(next httpsnoop.WriteStringFunc) httpsnoop.WriteStringFunc {
+			return func(s string) (int, error) {
+				startStream()
+				headerWritten = true
+				n, err := next(s)
+				if resCapture != nil {
+					resCapture.writeString(s[:n])
+				}
+				if stream != nil {
+					stream.write([]byte(s[:n]))
+				}
+				return n, err
+			}
+		},
+		ReadFrom: func(next httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+			return func(src io.Reader) (int64, error) {
+				headerWritten = true
+				if resCapture != nil {
+					src = resCapture.reader(src)
+				}
+				return next(src)
+			}
+		},
+		Flush: func(next httpsnoop.FlushFunc) httpsnoop.FlushFunc {
+			return func() {
+				startStream()
+				headerWritten = true
+				next()
+			}
+		},
+		Hijack: func(next httpsnoop.HijackFunc) httpsnoop.HijackFunc {
+			return func() (net.Conn, *bufio.ReadWriter, error) {
+				conn, brw, err := next()
+				if err != nil {
+					return conn, brw, err
+				}
+				headerWritten = true
+				hijacked = true
+				conn, brw = h.hijacked(ctx, req, skip, conn, brw)
+				return conn, brw, nil
+			}
+		},
+	})
+
+	if h.inFlightWarning > 0 && !skip {
+		t := h.startInFlightWarning(ctx, req)
+		defer t.Stop()
+	}
+
+	// Detect the request being canceled while the handler is running, usually
+	// because the client disconnected. The context is always canceled after
+	// the request completes, so a function that never runs before then is
+	// enough.
+	stopCancelWatch := context.AfterFunc(ctx, func() {})
+
+	// The writer passed to the handler, which records the metrics of anything
+	// written to it, including a response to a recovered panic.
+	metricsWriter := w
+
 	defer func(ctx context.Context) {
+		canceled := !stopCancelWatch()
+		if stream != nil {
+			stream.stop()
+		}
+
 		var stack []byte
 		var servePanic any
+		responded := false
 		if err := recover(); err != nil {
 			servePanic = err
-			defer panic(servePanic)
+			switch {
+			case !h.recover || isAbortHandler(servePanic):
+				defer panic(servePanic)
+			case headerWritten:
+				// Too late to respond, abort the response without net/http
+				// logging the panic again.
+				defer panic(http.ErrAbortHandler)
+			default:
+				h.onPanic(metricsWriter, req, servePanic)
+				responded = true
+			}
 
-			pooled := stacks.Get().(*[]byte) //nolint:forcetypeassert // pool type well defined
-			defer stacks.Put(pooled)
-			n := runtime.Stack(*pooled, false)
+			pooled := h.stacks.Get().(*[]byte) //nolint:forcetypeassert // pool type well defined
+			defer h.stacks.Put(pooled)
+			n := runtime.Stack(*pooled, h.stackAll)
 			stack = (*pooled)[:n]
 		}
 
+		var cancel *cancellation
+		if canceled {
+			cancel = newCancellation(ctx, servePanic == nil)
+		}
+
+		status := metrics.Code
+		switch {
+		case servePanic != nil && !responded:
+			// It is possible for a handler to flush a different status code before
+			// panicking, but almost all cases will still cause the client side to
+			// treat the response as an unknown error and the request is actually an
+			// error. We go ahead and always use 500 for a panic. This is suspicious
+			// but seems better in practice. If the panic was recovered, we log
+			// the response that was actually sent instead.
+			status = http.StatusInternalServerError
+		case servePanic != nil:
+			// Keep the status written by respond.
+		case cancel != nil && cancel.reason == cancelReasonClient:
+			// Whatever the handler wrote was not received by the client.
+			status = statusClientClosedRequest
+		}
+
+		// Spans and metrics record the status that was actually sent rather
+		// than the one we log for panics and cancellations, and none if a
+		// panic propagated before anything was sent. If the handler returned
+		// without writing, the server sends the default status.
+		statusSent := servePanic == nil || headerWritten || responded
+		route, _ := state.routeAndHandler(req.Pattern)
+		errType := errorType(servePanic, cancel, metrics.Code)
+		if span != nil {
+			finishServerSpan(span, req.Method, route, metrics.Code, statusSent, errType, servePanic, stack)
+		}
+		if h.metrics != nil {
+			var reqSize int64
+			if body != nil {
+				reqSize = body.n.Load()
+			}
+			h.metrics.finish(ctx, req, metricAttrs, route, metrics.Code, statusSent, errType, metrics.Duration, reqSize, metrics.Written)
+		}
+
+		if hijacked && servePanic == nil {
+			return
+		}
+
+		var level slog.Level
+		if servePanic == nil {
+			level = h.statusLevel(status)
+			if cancel != nil && cancel.reason == cancelReasonTimeout {
+				level = max(level, slog.LevelError)
+			}
+			if h.slowThreshold > 0 && metrics.Duration >= h.slowThreshold {
+				level = max(level, slog.LevelWarn)
+			}
+			if h.parentLogger != nil {
+				if child, ok := state.maxChildLevel(); ok {
+					level = max(level, child)
+				}
+			}
+			if h.routeLevel != nil {
+				level = h.routeLevel(req, level)
+			}
+			if skip || !h.sampled(level, metrics.Duration) {
+				return
+			}
+		}
+
 		reqAttrs := []any{
 			slog.String("requestMethod", req.Method),
 			slog.String("requestUrl", req.URL.String()),
 			slog.String("protocol", req.Proto),
-			slog.String("remoteIp", req.RemoteAddr),
+			slog.String("remoteIp", state.clientIP),
 			slog.Int64("responseSize", metrics.Written),
 			slog.String("latency", fmt.Sprintf("%.9fs", metrics.Duration.Seconds())),
 		}
+		if body != nil {
+			reqAttrs = append(reqAttrs, slog.Int64("requestSize", body.n.Load()))
+		}
 		if ua := req.Header.Get("User-Agent"); ua != "" {
 			reqAttrs = append(reqAttrs, slog.String("userAgent", ua))
 		}
-		if servePanic != nil {
-			// It is possible for a handler to flush a different status code before
-			// panicking, but almost all cases will still cause the client side to
-			// treat the response as an unknown error and the request is actually an
-			// error. We go ahead and always use 500 for a panic. This is suspicious
-			// but seems better in practice.
-			reqAttrs = append(reqAttrs, slog.Int("status", 500))
-		} else {
-			reqAttrs = append(reqAttrs, slog.Int("status", metrics.Code))
+		if referer := req.Header.Get("Referer"); referer != "" {
+			reqAttrs = append(reqAttrs, slog.String("referer", referer))
 		}
+		if ip := serverIP(ctx); ip != "" {
+			reqAttrs = append(reqAttrs, slog.String("serverIp", ip))
+		}
+		state.mu.Lock()
+		c := state.cache
+		state.mu.Unlock()
+		if c != nil {
+			reqAttrs = append(reqAttrs,
+				slog.Bool("cacheLookup", c.Lookup),
+				slog.Bool("cacheHit", c.Hit),
+				slog.Bool("cacheValidatedWithOriginServer", c.ValidatedWithOriginServer),
+			)
+			if c.FillBytes > 0 {
+				reqAttrs = append(reqAttrs, slog.Int64("cacheFillBytes", c.FillBytes))
+			}
+		}
+		reqAttrs = append(reqAttrs, slog.Int("status", status))
 
-		logArgs := append([]any{
-			slog.Group("httpRequest", reqAttrs...),
-		}, extraAttrs...)
-		if stack != nil {
-			logArgs = append(logArgs, slog.String("stack_trace", string(stack)))
+		logArgs := []any{slog.Group("httpRequest", reqAttrs...)}
+		logArgs = h.appendHeaders(logArgs, req.Header, w.Header())
+		logArgs = append(logArgs, h.stateAttrs(state, req.Pattern)...)
+		if cancel != nil {
+			logArgs = append(logArgs, cancel.attr())
+		}
+		if stream != nil {
+			logArgs = append(logArgs, stream.attr())
+		}
+		var reqBody, resBody *bodyCapture
+		if body != nil {
+			reqBody = body.capture
+		}
+		if resCapture != nil {
+			resBody = resCapture.body
+		}
+		logArgs = h.appendBodies(logArgs, status, reqBody, resBody)
+		for _, a := range state.extra.Attrs() {
+			logArgs = append(logArgs, a)
 		}
 
-		l := h.logger
-		if l == nil {
-			l = slog.Default()
+		l := h.requestLogger()
+		if servePanic == nil {
+			l.Log(ctx, level, "Server Request", logArgs...)
+			return
 		}
-		l.InfoContext(ctx, "Server Request", logArgs...)
+
+		logPanic(ctx, l, servePanic, stack, logArgs)
 	}(ctx)
 
 	metrics.CaptureMetrics(w, func(ww http.ResponseWriter) {
+		metricsWriter = ww
 		h.next.ServeHTTP(ww, req)
 	})
 }
 
-// Cap stack trace recording to 4KB.
-var stacks = sync.Pool{New: func() any {
-	buf := make([]byte, 4096)
-	return &buf
-}}
+// logPanic logs a panic in the format recognized by Error Reporting. The stack
+// trace must follow the message in the same format as an unrecovered panic for
+// it to be parsed.
+func logPanic(ctx context.Context, l *slog.Logger, v any, stack []byte, logArgs []any) {
+	msg := "panic: " + fmt.Sprint(v)
+	logArgs = append(logArgs,
+		slog.String("@type", reportedErrorEventType),
+		slog.Any("error", panicError{value: v}),
+		slog.String("stack_trace", msg+"\n\n"+string(stack)),
+	)
+	l.ErrorContext(ctx, msg, logArgs...)
+}
+
+// serverIP returns the IP address of the server that received the request,
+// without the port.
+func serverIP(ctx context.Context) string {
+	addr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return ""
+}
+
+// countingBody is a request body that counts the bytes read from it.
+// If capture is set, the bytes are also recorded to it.
+type countingBody struct {
+	io.ReadCloser
+
+	n       atomic.Int64
+	capture *bodyCapture
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	if b.capture != nil {
+		_, _ = b.capture.Write(p[:n])
+	}
+	return n, err //nolint:wrapcheck // pass through body errors like io.EOF
+}
+
+func defaultStatusLevel(status int) slog.Level {
+	switch {
+	case status >= 500:
+		return slog.LevelError
+	case status >= 400:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func isAbortHandler(v any) bool {
+	err, ok := v.(error)
+	return ok && errors.Is(err, http.ErrAbortHandler)
+}
+
+func respondInternalServerError(w http.ResponseWriter, _ *http.Request, _ any) {
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+const reportedErrorEventType = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+
+// panicError is a recovered panic value as an error.
+type panicError struct {
+	value any
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprint(e.value)
+}
+
+func (e panicError) Unwrap() error {
+	if err, ok := e.value.(error); ok {
+		return err
+	}
+	return nil
+}
 
 type config struct {
-	logger *slog.Logger
+	logger       *slog.Logger
+	maxStackSize int
+	stackAll     bool
+	recover      bool
+	onPanic      func(w http.ResponseWriter, req *http.Request, v any)
+	statusLevel  func(status int) slog.Level
+	routeLevel   func(req *http.Request, level slog.Level) slog.Level
+
+	trustedProxies  []netip.Prefix
+	trustedHops     int
+	forwardedHeader bool
+
+	skip       []func(req *http.Request) bool
+	sampleRate float64
+	sampleSlow time.Duration
+
+	slowThreshold   time.Duration
+	inFlightWarning time.Duration
+
+	routeLabels bool
+
+	requestIDHeader string
+
+	streamProgress time.Duration
+
+	meterProvider  metric.MeterProvider
+	tracerProvider trace.TracerProvider
+
+	parentLogger *slog.Logger
+
+	captureRequestLimit  int
+	captureResponseLimit int
+	captureContentTypes  []string
+	captureStatus        func(status int) bool
+	redactBody           func(contentType string, body []byte) []byte
+
+	requestHeaders  *headerMatcher
+	responseHeaders *headerMatcher
+	maskedHeaders   *headerMatcher
+	redactHeader    func(name string, value string) string
+}
+
+func (c *config) getLogger() *slog.Logger {
+	if c.logger != nil {
+		return c.logger
+	}
+	return slog.Default()
 }
 
 // Option is a configuration option for NewMiddleware.
@@ -124,15 +573,89 @@ func (o *loggerOption) apply(conf *config) {
 	conf.logger = o.logger
 }
 
-type extraAttrsContextKeyType struct{}
+// defaultMaxStackSize is the maximum size of recorded stack traces if not
+// set with MaxStackSize.
+const defaultMaxStackSize = 4096
+
+// MaxStackSize returns an Option to set the maximum size in bytes of the stack
+// trace recorded when a handler panics. Stack traces longer than this are
+// truncated. If not provided, or if size is not positive, stack traces are
+// capped at 4KB.
+func MaxStackSize(size int) Option {
+	if size <= 0 {
+		size = defaultMaxStackSize
+	}
+	return maxStackSizeOption(size)
+}
+
+type maxStackSizeOption int
+
+func (o maxStackSizeOption) apply(conf *config) {
+	conf.maxStackSize = int(o)
+}
 
-var extraAttrsContextKey = extraAttrsContextKeyType{}
+// StackAllGoroutines returns an Option to record the stack traces of all
+// goroutines rather than only the panicking one when a handler panics. This
+// can help debugging deadlocks or other interactions between goroutines, and
+// generally should be combined with a larger MaxStackSize.
+func StackAllGoroutines() Option {
+	return stackAllGoroutinesOption{}
+}
 
-// AddExtraAttr adds an extra [slog.Attr] record with the request log for the
-// given context. If the context does not originate from the requestlog middleware,
-// it is ignored.
-func AddExtraAttr(ctx context.Context, attr slog.Attr) {
-	if attrs, ok := ctx.Value(extraAttrsContextKey).(*[]any); ok {
-		*attrs = append(*attrs, attr)
+type stackAllGoroutinesOption struct{}
+
+func (o stackAllGoroutinesOption) apply(conf *config) {
+	conf.stackAll = true
+}
+
+// StatusLevel returns an Option to set the function mapping the response
+// status of a request to the level it is logged at. If not provided, 5xx
+// responses are logged at ERROR, 4xx at WARN, and others at INFO. Requests that
+// panic are always logged at ERROR.
+func StatusLevel(f func(status int) slog.Level) Option {
+	return statusLevelOption(f)
+}
+
+type statusLevelOption func(status int) slog.Level
+
+func (o statusLevelOption) apply(conf *config) {
+	conf.statusLevel = o
+}
+
+// RouteLevel returns an Option to adjust the level a request is logged at
+// after it is determined from the response status. f is called with the
+// request after it has been served, so [http.Request.Pattern] is populated
+// when the middleware wraps an [http.ServeMux]. For example, it can lower the
+// level of 404 responses for routes where they are expected.
+func RouteLevel(f func(req *http.Request, level slog.Level) slog.Level) Option {
+	return routeLevelOption(f)
+}
+
+type routeLevelOption func(req *http.Request, level slog.Level) slog.Level
+
+func (o routeLevelOption) apply(conf *config) {
+	conf.routeLevel = o
+}
+
+// Recover returns an Option to recover from panics in the handler rather than
+// propagating them to the server, which closes the connection without a
+// response. If the response headers have not been sent yet, respond is called
+// with the recovered value to write a response, or if respond is nil, a 500
+// Internal Server Error is returned. If they have already been sent, the
+// handler is aborted by panicking with [http.ErrAbortHandler], which the
+// server handles without logging. Handlers that panic with
+// [http.ErrAbortHandler] themselves are always aborted. The request log
+// records the status and size of the response written by respond.
+func Recover(respond func(w http.ResponseWriter, req *http.Request, v any)) Option {
+	if respond == nil {
+		respond = respondInternalServerError
 	}
+	return recoverOption(respond)
+}
+
+type recoverOption func(w http.ResponseWriter, req *http.Request, v any)
+
+func (o recoverOption) apply(conf *config) {
+	conf.recover = true
+	conf.onPanic = o
 }
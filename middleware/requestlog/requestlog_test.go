@@ -2,33 +2,55 @@ package requestlog
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/curioswitch/go-usegcp/gcpslog"
 )
 
 type gcpRequest struct {
-	RequestMethod string `json:"requestMethod,omitempty"`
-	RequestURL    string `json:"requestUrl,omitempty"`
-	Protocol      string `json:"protocol,omitempty"`
-	Status        int    `json:"status,omitempty"`
-	UserAgent     string `json:"userAgent,omitempty"`
-	RemoteIP      string `json:"remoteIp,omitempty"`
-	ResponseSize  int64  `json:"responseSize,omitempty"`
-	Latency       string `json:"latency,omitempty"`
+	RequestMethod                  string `json:"requestMethod,omitempty"`
+	RequestURL                     string `json:"requestUrl,omitempty"`
+	Protocol                       string `json:"protocol,omitempty"`
+	Status                         int    `json:"status,omitempty"`
+	UserAgent                      string `json:"userAgent,omitempty"`
+	Referer                        string `json:"referer,omitempty"`
+	RemoteIP                       string `json:"remoteIp,omitempty"`
+	ServerIP                       string `json:"serverIp,omitempty"`
+	RequestSize                    int64  `json:"requestSize,omitempty"`
+	ResponseSize                   int64  `json:"responseSize,omitempty"`
+	Latency                        string `json:"latency,omitempty"`
+	CacheLookup                    bool   `json:"cacheLookup,omitempty"`
+	CacheHit                       bool   `json:"cacheHit,omitempty"`
+	CacheValidatedWithOriginServer bool   `json:"cacheValidatedWithOriginServer,omitempty"`
+	CacheFillBytes                 int64  `json:"cacheFillBytes,omitempty"`
 }
 
 type gcpRecord struct {
+	Level       string      `json:"level,omitempty"`
+	Message     string      `json:"msg,omitempty"`
 	HTTPRequest *gcpRequest `json:"httpRequest,omitempty"`
+	Type        string      `json:"@type,omitempty"`
+	Error       string      `json:"error,omitempty"`
 	StackTrace  string      `json:"stack_trace,omitempty"`
 
+	Route   string            `json:"route,omitempty"`
+	Handler string            `json:"handler,omitempty"`
+	Labels  map[string]string `json:"logging.googleapis.com/labels,omitempty"`
+
 	// Extra attributes for testing.
 	Animal string `json:"animal,omitempty"`
 }
@@ -50,12 +72,14 @@ func TestMiddleware(t *testing.T) {
 			}),
 
 			record: &gcpRecord{
+				Level:   "INFO",
+				Message: "Server Request",
 				HTTPRequest: &gcpRequest{
 					RequestMethod: http.MethodGet,
 					RequestURL:    "/",
 					Protocol:      "HTTP/1.1",
 					Status:        http.StatusOK,
-					RemoteIP:      "192.0.2.1:1234",
+					RemoteIP:      "192.0.2.1",
 					ResponseSize:  0,
 				},
 			},
@@ -72,13 +96,15 @@ func TestMiddleware(t *testing.T) {
 			}),
 
 			record: &gcpRecord{
+				Level:   "INFO",
+				Message: "Server Request",
 				HTTPRequest: &gcpRequest{
 					RequestMethod: http.MethodGet,
 					RequestURL:    "/",
 					Protocol:      "HTTP/1.1",
 					UserAgent:     "curioswitch",
 					Status:        http.StatusOK,
-					RemoteIP:      "192.0.2.1:1234",
+					RemoteIP:      "192.0.2.1",
 					ResponseSize:  0,
 				},
 			},
@@ -92,16 +118,94 @@ func TestMiddleware(t *testing.T) {
 			}),
 
 			record: &gcpRecord{
+				Level:   "INFO",
+				Message: "Server Request",
 				HTTPRequest: &gcpRequest{
 					RequestMethod: http.MethodPost,
 					RequestURL:    "/bear",
 					Protocol:      "HTTP/1.1",
 					Status:        http.StatusOK,
-					RemoteIP:      "192.0.2.1:1234",
+					RemoteIP:      "192.0.2.1",
 					ResponseSize:  4,
 				},
 			},
 		},
+		{
+			name: "request body",
+			req:  httptest.NewRequest(http.MethodPost, "/bear", strings.NewReader("who")),
+			next: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_, _ = io.ReadAll(req.Body)
+				w.WriteHeader(http.StatusOK)
+			}),
+
+			record: &gcpRecord{
+				Level:   "INFO",
+				Message: "Server Request",
+				HTTPRequest: &gcpRequest{
+					RequestMethod: http.MethodPost,
+					RequestURL:    "/bear",
+					Protocol:      "HTTP/1.1",
+					Status:        http.StatusOK,
+					RemoteIP:      "192.0.2.1",
+					RequestSize:   3,
+				},
+			},
+		},
+		{
+			name: "referer and server ip",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Referer", "https://curioswitch.org/")
+				return req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey,
+					&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080}))
+			}(),
+			next: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+
+			record: &gcpRecord{
+				Level:   "INFO",
+				Message: "Server Request",
+				HTTPRequest: &gcpRequest{
+					RequestMethod: http.MethodGet,
+					RequestURL:    "/",
+					Protocol:      "HTTP/1.1",
+					Status:        http.StatusOK,
+					Referer:       "https://curioswitch.org/",
+					RemoteIP:      "192.0.2.1",
+					ServerIP:      "10.0.0.1",
+				},
+			},
+		},
+		{
+			name: "cache info",
+			req:  httptest.NewRequest(http.MethodGet, "/", nil),
+			next: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				SetCacheInfo(req.Context(), CacheInfo{
+					Lookup:                    true,
+					Hit:                       true,
+					ValidatedWithOriginServer: true,
+					FillBytes:                 10,
+				})
+				w.WriteHeader(http.StatusOK)
+			}),
+
+			record: &gcpRecord{
+				Level:   "INFO",
+				Message: "Server Request",
+				HTTPRequest: &gcpRequest{
+					RequestMethod:                  http.MethodGet,
+					RequestURL:                     "/",
+					Protocol:                       "HTTP/1.1",
+					Status:                         http.StatusOK,
+					RemoteIP:                       "192.0.2.1",
+					CacheLookup:                    true,
+					CacheHit:                       true,
+					CacheValidatedWithOriginServer: true,
+					CacheFillBytes:                 10,
+				},
+			},
+		},
 		{
 			name: "extra attrs",
 			req:  httptest.NewRequest(http.MethodGet, "/", nil),
@@ -111,17 +215,39 @@ func TestMiddleware(t *testing.T) {
 			}),
 
 			record: &gcpRecord{
+				Level:   "INFO",
+				Message: "Server Request",
 				HTTPRequest: &gcpRequest{
 					RequestMethod: http.MethodGet,
 					RequestURL:    "/",
 					Protocol:      "HTTP/1.1",
 					Status:        http.StatusOK,
-					RemoteIP:      "192.0.2.1:1234",
+					RemoteIP:      "192.0.2.1",
 					ResponseSize:  0,
 				},
 				Animal: "bear",
 			},
 		},
+		{
+			name: "client error status",
+			req:  httptest.NewRequest(http.MethodGet, "/missing", nil),
+			next: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			}),
+
+			record: &gcpRecord{
+				Level:   "WARN",
+				Message: "Server Request",
+				HTTPRequest: &gcpRequest{
+					RequestMethod: http.MethodGet,
+					RequestURL:    "/missing",
+					Protocol:      "HTTP/1.1",
+					Status:        http.StatusNotFound,
+					RemoteIP:      "192.0.2.1",
+					ResponseSize:  0,
+				},
+			},
+		},
 		{
 			name: "error status",
 			req:  httptest.NewRequest(http.MethodPut, "/error", nil),
@@ -130,12 +256,14 @@ func TestMiddleware(t *testing.T) {
 			}),
 
 			record: &gcpRecord{
+				Level:   "ERROR",
+				Message: "Server Request",
 				HTTPRequest: &gcpRequest{
 					RequestMethod: http.MethodPut,
 					RequestURL:    "/error",
 					Protocol:      "HTTP/1.1",
 					Status:        http.StatusInternalServerError,
-					RemoteIP:      "192.0.2.1:1234",
+					RemoteIP:      "192.0.2.1",
 					ResponseSize:  0,
 				},
 			},
@@ -148,14 +276,18 @@ func TestMiddleware(t *testing.T) {
 			}),
 
 			record: &gcpRecord{
+				Level:   "ERROR",
+				Message: "panic: failure",
 				HTTPRequest: &gcpRequest{
 					RequestMethod: http.MethodGet,
 					RequestURL:    "/",
 					Status:        500,
 					Protocol:      "HTTP/1.1",
-					RemoteIP:      "192.0.2.1:1234",
+					RemoteIP:      "192.0.2.1",
 					ResponseSize:  0,
 				},
+				Type:       "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent",
+				Error:      "failure",
 				StackTrace: "github.com/curioswitch/go-usegcp/middleware/requestlog.TestMiddleware",
 			},
 			panicErr: errors.New("failure"),
@@ -169,14 +301,18 @@ func TestMiddleware(t *testing.T) {
 			}),
 
 			record: &gcpRecord{
+				Level:   "ERROR",
+				Message: "panic: failure",
 				HTTPRequest: &gcpRequest{
 					RequestMethod: http.MethodGet,
 					RequestURL:    "/",
 					Status:        500,
 					Protocol:      "HTTP/1.1",
-					RemoteIP:      "192.0.2.1:1234",
+					RemoteIP:      "192.0.2.1",
 					ResponseSize:  0,
 				},
+				Type:       "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent",
+				Error:      "failure",
 				StackTrace: "github.com/curioswitch/go-usegcp/middleware/requestlog.TestMiddleware",
 			},
 			panicErr: errors.New("failure"),
@@ -216,6 +352,7 @@ func TestMiddleware(t *testing.T) {
 			if tc.record.StackTrace == "" {
 				require.Empty(t, rec.StackTrace)
 			} else {
+				require.True(t, strings.HasPrefix(rec.StackTrace, tc.record.Message+"\n\ngoroutine "))
 				require.Contains(t, rec.StackTrace, tc.record.StackTrace)
 				tc.record.StackTrace = ""
 				rec.StackTrace = ""
@@ -225,3 +362,808 @@ func TestMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestMiddlewarePanicStack(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+
+		maxSize    int
+		goroutines int
+	}{
+		{
+			name: "default",
+
+			maxSize:    4096,
+			goroutines: 1,
+		},
+		{
+			name: "small",
+			opts: []Option{MaxStackSize(100)},
+
+			maxSize:    100,
+			goroutines: 1,
+		},
+		{
+			name: "negative",
+			opts: []Option{MaxStackSize(-1)},
+
+			maxSize:    4096,
+			goroutines: 1,
+		},
+		{
+			name: "all goroutines",
+			opts: []Option{MaxStackSize(1 << 20), StackAllGoroutines()},
+
+			maxSize:    1 << 20,
+			goroutines: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+			h := NewMiddleware(append([]Option{Logger(logger)}, tc.opts...)...)(
+				http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+					panic("failure")
+				}))
+			require.PanicsWithValue(t, "failure", func() {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			})
+
+			rec := &gcpRecord{}
+			require.NoError(t, json.Unmarshal(output.Bytes(), rec))
+			require.Equal(t, "failure", rec.Error)
+
+			stack, ok := strings.CutPrefix(rec.StackTrace, "panic: failure\n\n")
+			require.True(t, ok)
+			require.LessOrEqual(t, len(stack), tc.maxSize)
+			require.GreaterOrEqual(t, strings.Count(stack, "goroutine "), tc.goroutines)
+		})
+	}
+}
+
+func TestMiddlewareRecover(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter, req *http.Request, v any)
+		next    http.Handler
+
+		status   int
+		body     string
+		panicErr error
+
+		logStatus int
+		logSize   int64
+	}{
+		{
+			name: "default response",
+			next: http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+				panic(errors.New("failure"))
+			}),
+
+			status: http.StatusInternalServerError,
+			body:   "Internal Server Error\n",
+
+			logStatus: http.StatusInternalServerError,
+			logSize:   int64(len("Internal Server Error\n")),
+		},
+		{
+			name: "custom response",
+			respond: func(w http.ResponseWriter, _ *http.Request, v any) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = w.Write([]byte("recovered " + v.(error).Error()))
+			},
+			next: http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+				panic(errors.New("failure"))
+			}),
+
+			status: http.StatusServiceUnavailable,
+			body:   "recovered failure",
+
+			logStatus: http.StatusServiceUnavailable,
+			logSize:   int64(len("recovered failure")),
+		},
+		{
+			name: "headers sent",
+			next: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				panic(errors.New("failure"))
+			}),
+
+			status:   http.StatusOK,
+			panicErr: http.ErrAbortHandler,
+
+			logStatus: http.StatusInternalServerError,
+		},
+		{
+			name: "body sent",
+			next: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("partial"))
+				panic(errors.New("failure"))
+			}),
+
+			status:   http.StatusOK,
+			body:     "partial",
+			panicErr: http.ErrAbortHandler,
+
+			logStatus: http.StatusInternalServerError,
+			logSize:   int64(len("partial")),
+		},
+		{
+			name: "abort handler",
+			next: http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+				panic(http.ErrAbortHandler)
+			}),
+
+			status:   http.StatusOK,
+			panicErr: http.ErrAbortHandler,
+
+			logStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+			w := httptest.NewRecorder()
+
+			h := NewMiddleware(Logger(logger), Recover(tc.respond))(tc.next)
+
+			if tc.panicErr != nil {
+				require.PanicsWithError(t, tc.panicErr.Error(), func() {
+					h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+				})
+			} else {
+				require.NotPanics(t, func() {
+					h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+				})
+			}
+
+			require.Equal(t, tc.status, w.Code)
+			require.Equal(t, tc.body, w.Body.String())
+
+			rec := &gcpRecord{}
+			require.NoError(t, json.Unmarshal(output.Bytes(), rec))
+			require.Equal(t, "ERROR", rec.Level)
+			require.Equal(t, tc.logStatus, rec.HTTPRequest.Status)
+			require.Equal(t, tc.logSize, rec.HTTPRequest.ResponseSize)
+		})
+	}
+}
+
+func TestMiddlewareLevel(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		path   string
+		status int
+
+		level string
+	}{
+		{
+			name:   "default ok",
+			status: http.StatusOK,
+			level:  "INFO",
+		},
+		{
+			name:   "default redirect",
+			status: http.StatusFound,
+			level:  "INFO",
+		},
+		{
+			name: "status level",
+			opts: []Option{StatusLevel(func(status int) slog.Level {
+				if status >= 300 {
+					return slog.LevelWarn
+				}
+				return slog.LevelDebug
+			})},
+			status: http.StatusFound,
+			level:  "WARN",
+		},
+		{
+			name: "route level",
+			opts: []Option{RouteLevel(func(req *http.Request, level slog.Level) slog.Level {
+				if req.Pattern == "GET /users/{id}" && level == slog.LevelWarn {
+					return slog.LevelInfo
+				}
+				return level
+			})},
+			path:   "/users/1",
+			status: http.StatusNotFound,
+			level:  "INFO",
+		},
+		{
+			name: "route level other route",
+			opts: []Option{RouteLevel(func(req *http.Request, level slog.Level) slog.Level {
+				if req.Pattern == "GET /users/{id}" && level == slog.LevelWarn {
+					return slog.LevelInfo
+				}
+				return level
+			})},
+			path:   "/items/1",
+			status: http.StatusNotFound,
+			level:  "WARN",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+			mux := http.NewServeMux()
+			respond := func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tc.status)
+			}
+			mux.HandleFunc("GET /users/{id}", respond)
+			mux.HandleFunc("GET /items/{id}", respond)
+			mux.HandleFunc("GET /{$}", respond)
+
+			path := tc.path
+			if path == "" {
+				path = "/"
+			}
+
+			h := NewMiddleware(append([]Option{Logger(logger)}, tc.opts...)...)(mux)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+
+			rec := &gcpRecord{}
+			require.NoError(t, json.Unmarshal(output.Bytes(), rec))
+			require.Equal(t, tc.level, rec.Level)
+		})
+	}
+}
+
+func TestMiddlewareSkip(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		method    string
+		path      string
+		userAgent string
+		status    int
+		sleep     time.Duration
+		panics    bool
+
+		logged bool
+	}{
+		{
+			name:   "no options",
+			logged: true,
+		},
+		{
+			name:   "skip path",
+			opts:   []Option{SkipPaths("/healthz", "/internal/*")},
+			path:   "/healthz",
+			logged: false,
+		},
+		{
+			name:   "skip path pattern",
+			opts:   []Option{SkipPaths("/healthz", "/internal/*")},
+			path:   "/internal/status",
+			logged: false,
+		},
+		{
+			name:   "skip path other",
+			opts:   []Option{SkipPaths("/healthz", "/internal/*")},
+			path:   "/internal/status/deep",
+			logged: true,
+		},
+		{
+			name:   "skip method",
+			opts:   []Option{SkipMethods(http.MethodOptions, http.MethodHead)},
+			method: http.MethodOptions,
+			logged: false,
+		},
+		{
+			name:   "skip method other",
+			opts:   []Option{SkipMethods(http.MethodOptions, http.MethodHead)},
+			logged: true,
+		},
+		{
+			name:      "skip user agent",
+			opts:      []Option{SkipUserAgents("GoogleHC/", "kube-probe/")},
+			userAgent: "kube-probe/1.30",
+			logged:    false,
+		},
+		{
+			name:      "skip user agent other",
+			opts:      []Option{SkipUserAgents("GoogleHC/", "kube-probe/")},
+			userAgent: "curl/8.0.0",
+			logged:    true,
+		},
+		{
+			name: "skip func",
+			opts: []Option{Skip(func(req *http.Request) bool {
+				return req.URL.Query().Get("quiet") == "true"
+			})},
+			path:   "/?quiet=true",
+			logged: false,
+		},
+		{
+			name:   "skip panic",
+			opts:   []Option{SkipPaths("/healthz")},
+			path:   "/healthz",
+			panics: true,
+			logged: true,
+		},
+		{
+			name:   "sample none",
+			opts:   []Option{Sample(0, 0)},
+			logged: false,
+		},
+		{
+			name:   "sample all",
+			opts:   []Option{Sample(1, 0)},
+			logged: true,
+		},
+		{
+			name:   "sample client error",
+			opts:   []Option{Sample(0, 0)},
+			status: http.StatusNotFound,
+			logged: true,
+		},
+		{
+			name:   "sample server error",
+			opts:   []Option{Sample(0, 0)},
+			status: http.StatusServiceUnavailable,
+			logged: true,
+		},
+		{
+			name:   "sample slow",
+			opts:   []Option{Sample(0, time.Millisecond)},
+			sleep:  10 * time.Millisecond,
+			logged: true,
+		},
+		{
+			name:   "sample panic",
+			opts:   []Option{Sample(0, 0)},
+			panics: true,
+			logged: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			path := tc.path
+			if path == "" {
+				path = "/"
+			}
+			status := tc.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			req := httptest.NewRequest(method, path, nil)
+			if tc.userAgent != "" {
+				req.Header.Set("User-Agent", tc.userAgent)
+			}
+
+			opts := append([]Option{Logger(logger), Recover(nil)}, tc.opts...)
+			h := NewMiddleware(opts...)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				time.Sleep(tc.sleep)
+				if tc.panics {
+					panic("failure")
+				}
+				w.WriteHeader(status)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if tc.logged {
+				require.NotEmpty(t, output.String())
+			} else {
+				require.Empty(t, output.String())
+			}
+		})
+	}
+}
+
+func TestMiddlewareSlow(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		sleep time.Duration
+
+		level string
+	}{
+		{
+			name:  "fast",
+			opts:  []Option{SlowThreshold(time.Hour)},
+			level: "INFO",
+		},
+		{
+			name:  "slow",
+			opts:  []Option{SlowThreshold(time.Millisecond)},
+			sleep: 10 * time.Millisecond,
+			level: "WARN",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+			h := NewMiddleware(append([]Option{Logger(logger)}, tc.opts...)...)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				time.Sleep(tc.sleep)
+				w.WriteHeader(http.StatusOK)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			rec := &gcpRecord{}
+			require.NoError(t, json.Unmarshal(output.Bytes(), rec))
+			require.Equal(t, tc.level, rec.Level)
+		})
+	}
+}
+
+func TestMiddlewareInFlightWarning(t *testing.T) {
+	var output bytes.Buffer
+	warned := make(chan struct{})
+	var once sync.Once
+	logger := slog.New(slog.NewJSONHandler(writerFunc(func(p []byte) (int, error) {
+		defer once.Do(func() { close(warned) })
+		return output.Write(p)
+	}), &slog.HandlerOptions{}))
+
+	h := NewMiddleware(Logger(logger), InFlightWarning(time.Millisecond))(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		<-warned
+		w.WriteHeader(http.StatusOK)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/bear", nil))
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var warning struct {
+		gcpRecord
+
+		Elapsed string `json:"elapsed"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &warning))
+	require.Equal(t, "WARN", warning.Level)
+	require.Equal(t, "Request still in flight", warning.Message)
+	require.Equal(t, &gcpRequest{
+		RequestMethod: http.MethodGet,
+		RequestURL:    "/bear",
+		Protocol:      "HTTP/1.1",
+		RemoteIP:      "192.0.2.1",
+	}, warning.HTTPRequest)
+	require.NotEmpty(t, warning.Elapsed)
+
+	rec := &gcpRecord{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), rec))
+	require.Equal(t, "Server Request", rec.Message)
+}
+
+func TestMiddlewareInFlightWarningSkipped(t *testing.T) {
+	var output syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+	h := NewMiddleware(Logger(logger), InFlightWarning(time.Millisecond), SkipPaths("/healthz"))(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	require.Empty(t, output.Bytes())
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestMiddlewareRoute(t *testing.T) {
+	// Middleware between the request log and the mux which hides the pattern
+	// from the request log.
+	withContext := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, req.WithContext(req.Context()))
+		})
+	}
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		path   string
+		hidden bool
+
+		route   string
+		handler string
+		labels  map[string]string
+	}{
+		{
+			name:  "pattern",
+			path:  "/users/1",
+			route: "GET /users/{id}",
+		},
+		{
+			name:    "named handler",
+			path:    "/items/1",
+			route:   "GET /items/{id}",
+			handler: "GetItem",
+		},
+		{
+			name:   "pattern hidden",
+			path:   "/users/1",
+			hidden: true,
+		},
+		{
+			name:    "named handler hidden",
+			path:    "/items/1",
+			hidden:  true,
+			route:   "GET /items/{id}",
+			handler: "GetItem",
+		},
+		{
+			name:  "not found",
+			path:  "/bears/1",
+			route: "",
+		},
+		{
+			name:    "labels",
+			opts:    []Option{RouteLabels()},
+			path:    "/items/1",
+			route:   "GET /items/{id}",
+			handler: "GetItem",
+			labels: map[string]string{
+				"route":   "GET /items/{id}",
+				"handler": "GetItem",
+			},
+		},
+		{
+			name:   "labels pattern",
+			opts:   []Option{RouteLabels()},
+			path:   "/users/1",
+			route:  "GET /users/{id}",
+			labels: map[string]string{"route": "GET /users/{id}"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+			mux := http.NewServeMux()
+			respond := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			mux.Handle("GET /users/{id}", respond)
+			mux.Handle("GET /items/{id}", NamedHandler("GetItem", respond))
+
+			var next http.Handler = mux
+			if tc.hidden {
+				next = withContext(mux)
+			}
+
+			h := NewMiddleware(append([]Option{Logger(logger)}, tc.opts...)...)(next)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			rec := &gcpRecord{}
+			require.NoError(t, json.Unmarshal(output.Bytes(), rec))
+			require.Equal(t, tc.route, rec.Route)
+			require.Equal(t, tc.handler, rec.Handler)
+			require.Equal(t, tc.labels, rec.Labels)
+		})
+	}
+}
+
+func TestMiddlewareRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		reqID    string
+		expected string
+	}{
+		{
+			name:     "from request",
+			reqID:    "abcd-1234",
+			expected: "abcd-1234",
+		},
+		{
+			name:     "custom header",
+			header:   "X-Correlation-Id",
+			reqID:    "abcd-1234",
+			expected: "abcd-1234",
+		},
+		{
+			name: "generated",
+		},
+		{
+			name:  "invalid",
+			reqID: "abcd 1234\n",
+		},
+		{
+			name:  "too long",
+			reqID: strings.Repeat("a", 129),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(gcpslog.NewHandler(&output))
+
+			header := tc.header
+			if header == "" {
+				header = DefaultRequestIDHeader
+			}
+
+			var ctxID string
+			h := NewMiddleware(Logger(logger), RequestID(tc.header))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				ctxID = RequestIDFromContext(req.Context())
+				logger.InfoContext(req.Context(), "handling")
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.reqID != "" {
+				req.Header.Set(header, tc.reqID)
+			}
+			res := httptest.NewRecorder()
+			h.ServeHTTP(res, req)
+
+			if tc.expected != "" {
+				require.Equal(t, tc.expected, ctxID)
+			} else {
+				require.Len(t, ctxID, 26)
+			}
+			require.Equal(t, ctxID, res.Header().Get(header))
+
+			lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+			require.Len(t, lines, 2)
+			for _, line := range lines {
+				require.Equal(t, 1, strings.Count(line, `"requestId"`))
+				var rec struct {
+					RequestID string `json:"requestId"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(line), &rec))
+				require.Equal(t, ctxID, rec.RequestID)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		h := NewMiddleware(Logger(slog.New(slog.DiscardHandler)))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			require.Empty(t, RequestIDFromContext(req.Context()))
+			w.WriteHeader(http.StatusOK)
+		}))
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Empty(t, res.Header().Get(DefaultRequestIDHeader))
+	})
+}
+
+func TestMiddlewareCancellation(t *testing.T) {
+	type cancellationRecord struct {
+		Reason          string `json:"reason"`
+		Cause           string `json:"cause"`
+		HandlerFinished bool   `json:"handlerFinished"`
+	}
+
+	errGone := errors.New("client gone")
+
+	tests := []struct {
+		name   string
+		ctx    func(ctx context.Context) (context.Context, func())
+		panics bool
+
+		level        string
+		status       int
+		cancellation *cancellationRecord
+	}{
+		{
+			name: "not canceled",
+			ctx: func(ctx context.Context) (context.Context, func()) {
+				return ctx, nil
+			},
+			level:  "INFO",
+			status: http.StatusOK,
+		},
+		{
+			name: "client",
+			ctx: func(ctx context.Context) (context.Context, func()) {
+				ctx, cancel := context.WithCancel(ctx)
+				return ctx, cancel
+			},
+			level:  "WARN",
+			status: 499,
+			cancellation: &cancellationRecord{
+				Reason:          "client",
+				Cause:           "context canceled",
+				HandlerFinished: true,
+			},
+		},
+		{
+			name: "client cause",
+			ctx: func(ctx context.Context) (context.Context, func()) {
+				ctx, cancel := context.WithCancelCause(ctx)
+				return ctx, func() { cancel(errGone) }
+			},
+			level:  "WARN",
+			status: 499,
+			cancellation: &cancellationRecord{
+				Reason:          "client",
+				Cause:           "client gone",
+				HandlerFinished: true,
+			},
+		},
+		{
+			name: "client panic",
+			ctx: func(ctx context.Context) (context.Context, func()) {
+				ctx, cancel := context.WithCancel(ctx)
+				return ctx, cancel
+			},
+			panics: true,
+			level:  "ERROR",
+			status: http.StatusInternalServerError,
+			cancellation: &cancellationRecord{
+				Reason:          "client",
+				Cause:           "context canceled",
+				HandlerFinished: false,
+			},
+		},
+		{
+			name: "timeout",
+			ctx: func(ctx context.Context) (context.Context, func()) {
+				ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+				return ctx, func() {
+					<-ctx.Done()
+					cancel()
+				}
+			},
+			level:  "ERROR",
+			status: http.StatusOK,
+			cancellation: &cancellationRecord{
+				Reason:          "timeout",
+				Cause:           "context deadline exceeded",
+				HandlerFinished: true,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+			ctx, cancel := tc.ctx(t.Context())
+			h := NewMiddleware(Logger(logger), Recover(nil))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if cancel != nil {
+					cancel()
+					<-req.Context().Done()
+				}
+				if tc.panics {
+					panic("failure")
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil))
+
+			var rec struct {
+				gcpRecord
+
+				Cancellation *cancellationRecord `json:"cancellation"`
+			}
+			require.NoError(t, json.Unmarshal(output.Bytes(), &rec))
+			require.Equal(t, tc.level, rec.Level)
+			require.Equal(t, tc.status, rec.HTTPRequest.Status)
+			require.Equal(t, tc.cancellation, rec.Cancellation)
+		})
+	}
+}
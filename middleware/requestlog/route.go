@@ -0,0 +1,95 @@
+package requestlog
+
+import (
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// NamedHandler returns an [http.Handler] that records name as the handler of
+// requests to h in the request log, along with the pattern h was registered
+// with when it is served by an [http.ServeMux]. The middleware can already
+// record the pattern without it when it directly wraps the ServeMux, but any
+// middleware in between that creates a new request, for example with
+// [http.Request.WithContext], hides it.
+//
+//	mux.Handle("GET /users/{id}", requestlog.NamedHandler("GetUser", getUser))
+func NamedHandler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s := stateFromContext(req.Context()); s != nil {
+			s.mu.Lock()
+			s.handlerName = name
+			if req.Pattern != "" {
+				s.route = req.Pattern
+			}
+			s.mu.Unlock()
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// RouteLabels returns an Option to also record the route and handler name of
+// requests as labels of the request log, in addition to the route and handler
+// attributes. Labels are indexed by Cloud Logging, making them convenient to
+// group by in log-based metrics.
+func RouteLabels() Option {
+	return routeLabelsOption{}
+}
+
+type routeLabelsOption struct{}
+
+func (o routeLabelsOption) apply(conf *config) {
+	conf.routeLabels = true
+}
+
+// stateAttrs returns the attributes recorded in the request state other than
+// the extra attributes, using pattern as the route if one was not recorded by
+// NamedHandler. Labels set by the handler are merged with the route labels.
+func (c *config) stateAttrs(s *requestState, pattern string) []any {
+	route, name := s.routeAndHandler(pattern)
+
+	var attrs []any
+	if route != "" {
+		attrs = append(attrs, slog.String("route", route))
+	}
+	if name != "" {
+		attrs = append(attrs, slog.String("handler", name))
+	}
+	if s.requestID != "" {
+		attrs = append(attrs, slog.String("requestId", s.requestID))
+	}
+
+	labels := s.extra.Labels()
+	if c.routeLabels {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		if route != "" {
+			labels["route"] = route
+		}
+		if name != "" {
+			labels["handler"] = name
+		}
+	}
+	if len(labels) > 0 {
+		labelAttrs := make([]any, 0, len(labels))
+		for _, k := range slices.Sorted(maps.Keys(labels)) {
+			labelAttrs = append(labelAttrs, slog.String(k, labels[k]))
+		}
+		attrs = append(attrs, slog.Group("logging.googleapis.com/labels", labelAttrs...))
+	}
+	return attrs
+}
+
+// routeAndHandler returns the route and handler name recorded by
+// NamedHandler, using pattern as the route if one was not recorded.
+func (s *requestState) routeAndHandler(pattern string) (string, string) {
+	s.mu.Lock()
+	route, name := s.route, s.handlerName
+	s.mu.Unlock()
+	if route == "" {
+		route = pattern
+	}
+	return route, name
+}
@@ -0,0 +1,131 @@
+package requestlog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/curioswitch/go-usegcp/gcpslog"
+)
+
+// rpcInterceptor logs RPCs served by frameworks that provide their own
+// interceptors, such as gRPC and Connect, in the same format as the
+// middleware.
+type rpcInterceptor struct {
+	config
+
+	stacks *sync.Pool
+}
+
+func newRPCInterceptor(opts []Option) *rpcInterceptor {
+	conf := newConfig(opts)
+	return &rpcInterceptor{
+		config: conf,
+		stacks: newStackPool(conf.maxStackSize),
+	}
+}
+
+// rpcCall is the state of a single call being served.
+type rpcCall struct {
+	// ctx is the context passed to the handler.
+	ctx context.Context
+	// logCtx is the context to log with, which does not include the request
+	// ID attribute recorded in the request log itself.
+	logCtx context.Context
+
+	route string
+	start time.Time
+	state *requestState
+
+	// reqAttrs are the attributes of the httpRequest group known when the
+	// call starts.
+	reqAttrs []any
+}
+
+// start starts a call to route from clientIP, with the request ID read from
+// the request if it has one.
+func (i *rpcInterceptor) start(ctx context.Context, route string, clientIP string, reqID string, reqAttrs []any) *rpcCall {
+	state := &requestState{
+		clientIP: clientIP,
+		extra:    newExtraAttrs(),
+	}
+	ctx = context.WithValue(ctx, requestStateContextKey, state)
+	handlerCtx := ctx
+	if i.requestIDHeader != "" {
+		state.requestID = requestID(reqID)
+		handlerCtx = gcpslog.ContextWithAttrs(ctx, slog.String("requestId", state.requestID))
+	}
+
+	return &rpcCall{
+		ctx:      handlerCtx,
+		logCtx:   ctx,
+		route:    route,
+		start:    time.Now(),
+		state:    state,
+		reqAttrs: append(reqAttrs, slog.String("remoteIp", clientIP)),
+	}
+}
+
+// finish logs the call with the HTTP status corresponding to its result and
+// attrs specific to the RPC framework. If the handler panicked with
+// servePanic, the call is logged as a panic and the panic is propagated after
+// logging unless Recover is enabled.
+func (i *rpcInterceptor) finish(call *rpcCall, servePanic any, status int, attrs ...any) {
+	duration := time.Since(call.start)
+
+	var stack []byte
+	if servePanic != nil {
+		pooled := i.stacks.Get().(*[]byte) //nolint:forcetypeassert // pool type well defined
+		defer i.stacks.Put(pooled)
+		n := runtime.Stack(*pooled, i.stackAll)
+		stack = (*pooled)[:n]
+
+		if !i.recover {
+			defer panic(servePanic)
+		}
+		status = http.StatusInternalServerError
+	}
+
+	var level slog.Level
+	if servePanic == nil {
+		level = i.statusLevel(status)
+		if i.slowThreshold > 0 && duration >= i.slowThreshold {
+			level = max(level, slog.LevelWarn)
+		}
+		if !i.sampled(level, duration) {
+			return
+		}
+	}
+
+	reqAttrs := append(call.reqAttrs,
+		slog.String("latency", fmt.Sprintf("%.9fs", duration.Seconds())),
+		slog.Int("status", status),
+	)
+
+	logArgs := append([]any{slog.Group("httpRequest", reqAttrs...)}, attrs...)
+	logArgs = append(logArgs, i.stateAttrs(call.state, call.route)...)
+	for _, a := range call.state.extra.Attrs() {
+		logArgs = append(logArgs, a)
+	}
+
+	l := i.getLogger()
+	if servePanic == nil {
+		l.Log(call.logCtx, level, "Server Request", logArgs...)
+		return
+	}
+	logPanic(call.logCtx, l, servePanic, stack, logArgs)
+}
+
+// addrIP returns the IP address of addr, in the form host:port, without the
+// port.
+func addrIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,102 @@
+package requestlog
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Skip returns an Option to not log requests for which skip returns true. The
+// function is called before the request is served. Requests that panic are
+// always logged.
+func Skip(skip func(req *http.Request) bool) Option {
+	return skipOption(skip)
+}
+
+// SkipPaths returns an Option to not log requests with a URL path matching
+// any of patterns, using the syntax of [path.Match]. For example, "/healthz"
+// or "/internal/*". Requests that panic are always logged.
+func SkipPaths(patterns ...string) Option {
+	return skipOption(func(req *http.Request) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, req.URL.Path); ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// SkipMethods returns an Option to not log requests with any of the given
+// methods, for example [http.MethodOptions]. Requests that panic are always
+// logged.
+func SkipMethods(methods ...string) Option {
+	return skipOption(func(req *http.Request) bool {
+		return slices.Contains(methods, req.Method)
+	})
+}
+
+// SkipUserAgents returns an Option to not log requests with a User-Agent
+// starting with any of prefixes, for example "GoogleHC/" for load balancer
+// health checks or "kube-probe/" for Kubernetes probes. Requests that panic
+// are always logged.
+func SkipUserAgents(prefixes ...string) Option {
+	return skipOption(func(req *http.Request) bool {
+		ua := req.Header.Get("User-Agent")
+		for _, p := range prefixes {
+			if strings.HasPrefix(ua, p) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+type skipOption func(req *http.Request) bool
+
+func (o skipOption) apply(conf *config) {
+	conf.skip = append(conf.skip, o)
+}
+
+// Sample returns an Option to only log a fraction of successful requests,
+// given by rate between 0 and 1. Requests logged at WARN or higher, which by
+// default are those with a 4xx or 5xx status, are always logged, as are
+// requests that take at least slow to serve if slow is positive.
+func Sample(rate float64, slow time.Duration) Option {
+	return sampleOption{rate: rate, slow: slow}
+}
+
+type sampleOption struct {
+	rate float64
+	slow time.Duration
+}
+
+func (o sampleOption) apply(conf *config) {
+	conf.sampleRate = o.rate
+	conf.sampleSlow = o.slow
+}
+
+func (c *config) shouldSkip(req *http.Request) bool {
+	for _, skip := range c.skip {
+		if skip(req) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *config) sampled(level slog.Level, latency time.Duration) bool {
+	switch {
+	case c.sampleRate >= 1:
+		return true
+	case level >= slog.LevelWarn:
+		return true
+	case c.sampleSlow > 0 && latency >= c.sampleSlow:
+		return true
+	}
+	return rand.Float64() < c.sampleRate //nolint:gosec // sampling doesn't need secure randomness
+}
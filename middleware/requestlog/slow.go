@@ -0,0 +1,64 @@
+package requestlog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// SlowThreshold returns an Option to log requests that take at least d to
+// serve at WARN or higher, regardless of their response status. Combined with
+// Sample, slow requests are always logged.
+func SlowThreshold(d time.Duration) Option {
+	return slowThresholdOption(d)
+}
+
+type slowThresholdOption time.Duration
+
+func (o slowThresholdOption) apply(conf *config) {
+	conf.slowThreshold = time.Duration(o)
+}
+
+// InFlightWarning returns an Option to log a warning for requests that are
+// still being served after d, in addition to the request log once they
+// complete. This helps diagnose requests that never complete, for example
+// when Cloud Run terminates them after its request timeout, where the request
+// log would otherwise never be written. The warning includes the request, the
+// time elapsed so far, and the route if recorded with [NamedHandler]. It is
+// logged with the request's context to link it with its trace. Requests
+// excluded with Skip or its variants are not warned about.
+func InFlightWarning(d time.Duration) Option {
+	return inFlightWarningOption(d)
+}
+
+type inFlightWarningOption time.Duration
+
+func (o inFlightWarningOption) apply(conf *config) {
+	conf.inFlightWarning = time.Duration(o)
+}
+
+func (h *handler) startInFlightWarning(ctx context.Context, req *http.Request) *time.Timer {
+	start := time.Now()
+	// Read from the request before starting the timer to avoid racing with
+	// the handler.
+	reqAttrs := []any{
+		slog.String("requestMethod", req.Method),
+		slog.String("requestUrl", req.URL.String()),
+		slog.String("protocol", req.Proto),
+	}
+	state := stateFromContext(ctx)
+	reqAttrs = append(reqAttrs, slog.String("remoteIp", state.clientIP))
+
+	return time.AfterFunc(h.inFlightWarning, func() {
+		elapsed := time.Since(start)
+		// The pattern of the request can't be read safely while it is being
+		// served, so the route is only known if recorded by NamedHandler.
+		logArgs := append([]any{
+			slog.Group("httpRequest", reqAttrs...),
+			slog.String("elapsed", fmt.Sprintf("%.9fs", elapsed.Seconds())),
+		}, h.stateAttrs(state, "")...)
+		h.getLogger().WarnContext(withoutRequestState(ctx), "Request still in flight", logArgs...)
+	})
+}
@@ -0,0 +1,219 @@
+package requestlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamProgress returns an Option to log the progress of server-sent event
+// streams, responses with the content type text/event-stream, every interval
+// while they are being served. Progress logs include the time elapsed and the
+// number of bytes and events sent so far, which are also recorded in the
+// request log when the stream completes. Streams of requests excluded with Skip
+// or its variants are not logged.
+func StreamProgress(interval time.Duration) Option {
+	return streamProgressOption(interval)
+}
+
+type streamProgressOption time.Duration
+
+func (o streamProgressOption) apply(conf *config) {
+	conf.streamProgress = time.Duration(o)
+}
+
+// eventStream tracks a server-sent event stream.
+type eventStream struct {
+	start   time.Time
+	written atomic.Int64
+	events  atomic.Int64
+	ticker  *time.Ticker
+	done    chan struct{}
+	stopped chan struct{}
+
+	// prevNewline is whether the last byte written, ignoring carriage
+	// returns, ended a line. Only accessed by the handler goroutine.
+	prevNewline bool
+}
+
+// startEventStream starts tracking the response if it is an event stream,
+// returning nil otherwise.
+func (h *handler) startEventStream(ctx context.Context, req *http.Request, header http.Header) *eventStream {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		return nil
+	}
+
+	s := &eventStream{
+		start:   time.Now(),
+		ticker:  time.NewTicker(h.streamProgress),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	// Read from the request before starting the goroutine to avoid racing
+	// with the handler.
+	reqAttrs := []any{
+		slog.String("requestMethod", req.Method),
+		slog.String("requestUrl", req.URL.String()),
+		slog.String("protocol", req.Proto),
+		slog.String("remoteIp", stateFromContext(ctx).clientIP),
+	}
+	logCtx := withoutRequestState(ctx)
+	go func() {
+		defer close(s.stopped)
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-s.ticker.C:
+				h.getLogger().InfoContext(logCtx, "Stream Progress",
+					slog.Group("httpRequest", reqAttrs...),
+					s.attr(),
+				)
+			}
+		}
+	}()
+	return s
+}
+
+// write records p written to the stream, counting events as blank lines.
+func (s *eventStream) write(p []byte) {
+	s.written.Add(int64(len(p)))
+	var events int64
+	for _, b := range p {
+		switch b {
+		case '\r':
+		case '\n':
+			if s.prevNewline {
+				events++
+				s.prevNewline = false
+			} else {
+				s.prevNewline = true
+			}
+		default:
+			s.prevNewline = false
+		}
+	}
+	s.events.Add(events)
+}
+
+// stop stops logging progress, returning once any progress log in flight is
+// complete.
+func (s *eventStream) stop() {
+	s.ticker.Stop()
+	close(s.done)
+	<-s.stopped
+}
+
+func (s *eventStream) attr() slog.Attr {
+	return slog.Group("stream",
+		slog.String("elapsed", fmt.Sprintf("%.9fs", time.Since(s.start).Seconds())),
+		slog.Int64("bytesWritten", s.written.Load()),
+		slog.Int64("events", s.events.Load()),
+	)
+}
+
+// hijackedConn is a connection hijacked from the server, for example for a
+// WebSocket, which counts the bytes read and written and calls onClose when it
+// is closed.
+type hijackedConn struct {
+	net.Conn
+
+	read    atomic.Int64
+	written atomic.Int64
+	once    sync.Once
+	onClose func(read int64, written int64)
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err //nolint:wrapcheck // pass through connection errors like io.EOF
+}
+
+func (c *hijackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err //nolint:wrapcheck // pass through connection errors
+}
+
+func (c *hijackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.onClose(c.read.Load(), c.written.Load())
+	})
+	return err //nolint:wrapcheck // pass through connection errors
+}
+
+// hijacked logs the upgrade of a hijacked connection and returns the
+// connection and buffers to return to the handler, which log the request when
+// the connection is closed with its duration and the bytes read and written.
+func (h *handler) hijacked(ctx context.Context, req *http.Request, skip bool, conn net.Conn, brw *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter) {
+	start := time.Now()
+	state := stateFromContext(ctx)
+
+	status := http.StatusOK
+	upgrade := req.Header.Get("Upgrade")
+	if upgrade != "" {
+		status = http.StatusSwitchingProtocols
+	}
+	reqAttrs := []any{
+		slog.String("requestMethod", req.Method),
+		slog.String("requestUrl", req.URL.String()),
+		slog.String("protocol", req.Proto),
+		slog.String("remoteIp", state.clientIP),
+		slog.Int("status", status),
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "" {
+		reqAttrs = append(reqAttrs, slog.String("userAgent", ua))
+	}
+	var upgradeAttrs []any
+	if upgrade != "" {
+		upgradeAttrs = append(upgradeAttrs, slog.String("upgrade", upgrade))
+	}
+	upgradeAttrs = append(upgradeAttrs, h.stateAttrs(state, "")...)
+
+	level := h.statusLevel(status)
+	if !skip {
+		h.getLogger().Log(withoutRequestState(ctx), level, "Connection Upgraded",
+			append([]any{slog.Group("httpRequest", reqAttrs...)}, upgradeAttrs...)...)
+	}
+
+	hc := &hijackedConn{
+		Conn: conn,
+		onClose: func(read int64, written int64) {
+			duration := time.Since(start)
+			if skip || !h.sampled(level, duration) {
+				return
+			}
+			attrs := append(reqAttrs,
+				slog.Int64("requestSize", read),
+				slog.Int64("responseSize", written),
+				slog.String("latency", fmt.Sprintf("%.9fs", duration.Seconds())),
+			)
+			h.requestLogger().Log(ctx, level, "Server Request",
+				append([]any{slog.Group("httpRequest", attrs...)}, upgradeAttrs...)...)
+		},
+	}
+
+	// The buffers returned by the server use the connection directly, so
+	// replace them with ones using our connection, keeping any data that was
+	// already buffered.
+	var r io.Reader = hc
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		hc.read.Add(int64(n))
+		r = io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), hc)
+	}
+	_ = brw.Writer.Flush()
+	return hc, bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(hc))
+}
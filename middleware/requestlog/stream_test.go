@@ -0,0 +1,164 @@
+package requestlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHijack(t *testing.T) {
+	var output syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+	h := NewMiddleware(Logger(logger))(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+			_ = brw.Flush()
+			for {
+				line, err := brw.ReadString('\n')
+				if err != nil || line == "bye\n" {
+					return
+				}
+				_, _ = brw.WriteString(line)
+				_ = brw.Flush()
+			}
+		}()
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Send data along with the request so it is buffered by the server
+	// before hijacking.
+	_, err = io.WriteString(conn, "GET /echo HTTP/1.1\r\nHost: example.com\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nbear\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "bear\n", line)
+	_, err = io.WriteString(conn, "cat\n")
+	require.NoError(t, err)
+	line, err = r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "cat\n", line)
+	_, err = io.WriteString(conn, "bye\n")
+	require.NoError(t, err)
+
+	var lines []string
+	require.Eventually(t, func() bool {
+		lines = strings.Split(strings.TrimSpace(string(output.Bytes())), "\n")
+		return len(lines) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var upgraded struct {
+		gcpRecord
+
+		Upgrade string `json:"upgrade"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &upgraded))
+	require.Equal(t, "Connection Upgraded", upgraded.Message)
+	require.Equal(t, "INFO", upgraded.Level)
+	require.Equal(t, "echo", upgraded.Upgrade)
+	require.Equal(t, http.StatusSwitchingProtocols, upgraded.HTTPRequest.Status)
+	require.Equal(t, "/echo", upgraded.HTTPRequest.RequestURL)
+	require.Zero(t, upgraded.HTTPRequest.Latency)
+
+	var closed gcpRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &closed))
+	require.Equal(t, "Server Request", closed.Message)
+	require.Equal(t, http.StatusSwitchingProtocols, closed.HTTPRequest.Status)
+	require.Equal(t, int64(len("bear\ncat\nbye\n")), closed.HTTPRequest.RequestSize)
+	require.Equal(t, int64(len("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nbear\ncat\n")), closed.HTTPRequest.ResponseSize)
+	require.NotEmpty(t, closed.HTTPRequest.Latency)
+}
+
+func TestStreamProgress(t *testing.T) {
+	var output syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+	h := NewMiddleware(Logger(logger), StreamProgress(time.Millisecond))(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, animal := range []string{"bear", "cat", "dog"} {
+			_, _ = io.WriteString(w, "event: animal\r\ndata: "+animal+"\r\n\r\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/events", nil))
+
+	type streamRecord struct {
+		gcpRecord
+
+		Stream struct {
+			Elapsed      string `json:"elapsed"`
+			BytesWritten int64  `json:"bytesWritten"`
+			Events       int64  `json:"events"`
+		} `json:"stream"`
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(output.Bytes())), "\n")
+	require.Greater(t, len(lines), 1)
+
+	var progress streamRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &progress))
+	require.Equal(t, "Stream Progress", progress.Message)
+	require.Equal(t, "/events", progress.HTTPRequest.RequestURL)
+	require.NotEmpty(t, progress.Stream.Elapsed)
+
+	var final streamRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &final))
+	require.Equal(t, "Server Request", final.Message)
+	require.Equal(t, int64(3), final.Stream.Events)
+	require.Equal(t, final.HTTPRequest.ResponseSize, final.Stream.BytesWritten)
+}
+
+func TestStreamProgressNotEventStream(t *testing.T) {
+	var output syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+	h := NewMiddleware(Logger(logger), StreamProgress(time.Millisecond))(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "kuma")
+		time.Sleep(10 * time.Millisecond)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	lines := strings.Split(strings.TrimSpace(string(output.Bytes())), "\n")
+	require.Len(t, lines, 1)
+	require.NotContains(t, lines[0], `"stream"`)
+}
+
+func TestStreamProgressSkipped(t *testing.T) {
+	var output syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{}))
+
+	h := NewMiddleware(Logger(logger), StreamProgress(time.Millisecond), SkipPaths("/events"))(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: kuma\n\n")
+		time.Sleep(10 * time.Millisecond)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/events", nil))
+
+	require.Empty(t, output.Bytes())
+}
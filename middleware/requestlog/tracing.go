@@ -0,0 +1,156 @@
+package requestlog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerProvider returns an Option to start an OpenTelemetry server span for
+// requests using tp when the request context does not already have one, for
+// example because there is no OpenTelemetry handler in front of the
+// middleware. The parent of the span is extracted from the W3C traceparent
+// header, or the X-Cloud-Trace-Context header set by Google Cloud load
+// balancers if it is not present. The span is named by the route of the
+// request, records the status sent and any panic or cancellation, and is
+// ended after the request is logged, so the request log and logs of the
+// handler have its trace.
+func TracerProvider(tp trace.TracerProvider) Option {
+	return tracerProviderOption{tp: tp}
+}
+
+type tracerProviderOption struct {
+	tp trace.TracerProvider
+}
+
+func (o tracerProviderOption) apply(conf *config) {
+	conf.tracerProvider = o.tp
+}
+
+// cloudTraceContextHeader is the header used by Google Cloud to propagate
+// trace context, in the format TRACE_ID/SPAN_ID;o=OPTIONS where SPAN_ID is
+// decimal.
+const cloudTraceContextHeader = "X-Cloud-Trace-Context"
+
+// startServerSpan starts a server span for req if ctx does not have one
+// already, returning nil if it does.
+func startServerSpan(ctx context.Context, tracer trace.Tracer, req *http.Request) (context.Context, trace.Span) {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() && !sc.IsRemote() {
+		return ctx, nil
+	}
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = extractTraceContext(ctx, req.Header)
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", req.Method),
+		attribute.String("url.scheme", urlScheme(req)),
+		attribute.String("url.path", req.URL.Path),
+	}
+	if req.Host != "" {
+		attrs = append(attrs, attribute.String("server.address", req.Host))
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "" {
+		attrs = append(attrs, attribute.String("user_agent.original", ua))
+	}
+	return tracer.Start(ctx, req.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// finishServerSpan records the result of a request on span, before it is
+// ended. code is the status code sent, if statusSent, and errType is the
+// error.type of the request, if any.
+func finishServerSpan(span trace.Span, method string, route string, code int, statusSent bool, errType string, servePanic any, stack []byte) {
+	if route != "" {
+		// Patterns of ServeMux already include the method if registered with
+		// one.
+		name := route
+		if !strings.HasPrefix(route, method+" ") {
+			name = method + " " + route
+		}
+		span.SetName(name)
+		span.SetAttributes(attribute.String("http.route", route))
+	}
+	if statusSent {
+		span.SetAttributes(attribute.Int("http.response.status_code", code))
+	}
+	if errType != "" {
+		span.SetAttributes(attribute.String("error.type", errType))
+	}
+
+	switch {
+	case servePanic != nil:
+		span.AddEvent("exception", trace.WithAttributes(
+			attribute.String("exception.type", fmt.Sprintf("%T", servePanic)),
+			attribute.String("exception.message", fmt.Sprint(servePanic)),
+			attribute.String("exception.stacktrace", string(stack)),
+		))
+		span.SetStatus(codes.Error, fmt.Sprintf("panic: %v", servePanic))
+	case errType == "timeout":
+		span.SetStatus(codes.Error, "request timed out")
+	case statusSent && code >= 500:
+		span.SetStatus(codes.Error, "")
+	}
+}
+
+// extractTraceContext returns ctx with the remote span context propagated in
+// header, if any.
+func extractTraceContext(ctx context.Context, header http.Header) context.Context {
+	ctx = propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(header))
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	if sc, ok := parseCloudTraceContext(header.Get(cloudTraceContextHeader)); ok {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, sc)
+	}
+	return ctx
+}
+
+// parseCloudTraceContext parses the value of an X-Cloud-Trace-Context header.
+func parseCloudTraceContext(v string) (trace.SpanContext, bool) {
+	if v == "" {
+		return trace.SpanContext{}, false
+	}
+	v, opts, _ := strings.Cut(v, ";")
+	traceHex, spanDec, _ := strings.Cut(v, "/")
+
+	traceID, err := trace.TraceIDFromHex(traceHex)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	var spanID trace.SpanID
+	if spanDec != "" {
+		n, err := strconv.ParseUint(spanDec, 10, 64)
+		if err != nil {
+			return trace.SpanContext{}, false
+		}
+		for i := range spanID {
+			spanID[i] = byte(n >> (8 * (len(spanID) - 1 - i)))
+		}
+	}
+	if !spanID.IsValid() {
+		// A remote parent must have a span, so a header with only a trace
+		// can't be used.
+		return trace.SpanContext{}, false
+	}
+
+	var flags trace.TraceFlags
+	if opts == "o=1" {
+		flags = trace.FlagsSampled
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: flags,
+		Remote:     true,
+	}), true
+}
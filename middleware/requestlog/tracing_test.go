@@ -0,0 +1,279 @@
+package requestlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/curioswitch/go-usegcp/gcpslog"
+)
+
+func TestTracing(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		header   http.Header
+		existing bool
+
+		spanName string
+		route    string
+		status   int
+		code     codes.Code
+		parent   string
+		panic    bool
+		errType  string
+		aborted  bool
+		// propagate is whether the handler is run without Recover, so a
+		// panic is propagated without sending a status.
+		propagate bool
+	}{
+		{
+			name:     "root",
+			path:     "/users/1",
+			spanName: "GET /users/{id}",
+			route:    "GET /users/{id}",
+			status:   http.StatusOK,
+		},
+		{
+			name:     "traceparent",
+			path:     "/users/1",
+			header:   http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}},
+			spanName: "GET /users/{id}",
+			route:    "GET /users/{id}",
+			status:   http.StatusOK,
+			parent:   "0af7651916cd43dd8448eb211c80319c/b7ad6b7169203331",
+		},
+		{
+			name: "cloud trace context",
+			path: "/users/1",
+			header: http.Header{
+				"X-Cloud-Trace-Context": {"105445aa7843bc8bf206b12000100000/1;o=1"},
+			},
+			spanName: "GET /users/{id}",
+			route:    "GET /users/{id}",
+			status:   http.StatusOK,
+			parent:   "105445aa7843bc8bf206b12000100000/0000000000000001",
+		},
+		{
+			name: "traceparent preferred",
+			path: "/users/1",
+			header: http.Header{
+				"Traceparent":           {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+				"X-Cloud-Trace-Context": {"105445aa7843bc8bf206b12000100000/1;o=1"},
+			},
+			spanName: "GET /users/{id}",
+			route:    "GET /users/{id}",
+			status:   http.StatusOK,
+			parent:   "0af7651916cd43dd8448eb211c80319c/b7ad6b7169203331",
+		},
+		{
+			name:     "route without method",
+			path:     "/items/1",
+			spanName: "GET /items/{id}",
+			route:    "/items/{id}",
+			status:   http.StatusBadGateway,
+			code:     codes.Error,
+			errType:  "502",
+		},
+		{
+			name:     "not found",
+			path:     "/bears/1",
+			spanName: "GET",
+			status:   http.StatusNotFound,
+		},
+		{
+			name:     "panic",
+			path:     "/panic",
+			spanName: "GET /panic",
+			route:    "GET /panic",
+			status:   http.StatusInternalServerError,
+			code:     codes.Error,
+			panic:    true,
+			errType:  "panic",
+		},
+		{
+			name:      "panic propagated",
+			path:      "/panic",
+			spanName:  "GET /panic",
+			route:     "GET /panic",
+			code:      codes.Error,
+			panic:     true,
+			errType:   "panic",
+			propagate: true,
+		},
+		{
+			name:     "panic after response",
+			path:     "/partial",
+			spanName: "GET /partial",
+			route:    "GET /partial",
+			status:   http.StatusOK,
+			code:     codes.Error,
+			panic:    true,
+			errType:  "panic",
+			aborted:  true,
+		},
+		{
+			name:     "canceled",
+			path:     "/cancel",
+			spanName: "GET /cancel",
+			route:    "GET /cancel",
+			status:   http.StatusOK,
+			errType:  "canceled",
+		},
+		{
+			name:     "existing span",
+			path:     "/users/1",
+			existing: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("hello"))
+			})
+			mux.HandleFunc("/items/{id}", func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			})
+			mux.HandleFunc("GET /panic", func(http.ResponseWriter, *http.Request) {
+				panic("oops")
+			})
+			mux.HandleFunc("GET /partial", func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("hello"))
+				panic("oops")
+			})
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			mux.HandleFunc("GET /cancel", func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("hello"))
+				cancel()
+			})
+
+			var out bytes.Buffer
+			opts := []Option{Logger(slog.New(gcpslog.NewHandler(&out))), TracerProvider(tp)}
+			if !tc.propagate {
+				opts = append(opts, Recover(nil))
+			}
+			h := NewMiddleware(opts...)(mux)
+
+			req := httptest.NewRequestWithContext(ctx, http.MethodGet, tc.path, nil)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			var existing trace.Span
+			if tc.existing {
+				ctx, span := tp.Tracer("test").Start(req.Context(), "existing")
+				existing = span
+				req = req.WithContext(ctx)
+			}
+			res := httptest.NewRecorder()
+			switch {
+			case tc.propagate:
+				require.PanicsWithValue(t, "oops", func() {
+					h.ServeHTTP(res, req)
+				})
+			case tc.aborted:
+				require.PanicsWithError(t, http.ErrAbortHandler.Error(), func() {
+					h.ServeHTTP(res, req)
+				})
+			default:
+				h.ServeHTTP(res, req)
+			}
+
+			if tc.existing {
+				existing.End()
+				spans := recorder.Ended()
+				require.Len(t, spans, 1)
+				require.Equal(t, "existing", spans[0].Name())
+				return
+			}
+
+			spans := recorder.Ended()
+			require.Len(t, spans, 1)
+			span := spans[0]
+			require.Equal(t, tc.spanName, span.Name())
+			require.Equal(t, trace.SpanKindServer, span.SpanKind())
+			require.Equal(t, tc.code, span.Status().Code)
+
+			attrs := map[attribute.Key]attribute.Value{}
+			for _, a := range span.Attributes() {
+				attrs[a.Key] = a.Value
+			}
+			if tc.status == 0 {
+				require.NotContains(t, attrs, attribute.Key("http.response.status_code"))
+			} else {
+				require.Equal(t, int64(tc.status), attrs["http.response.status_code"].AsInt64())
+			}
+			require.Equal(t, tc.route, attrs["http.route"].AsString())
+			require.Equal(t, "GET", attrs["http.request.method"].AsString())
+			require.Equal(t, tc.errType, attrs["error.type"].AsString())
+
+			if tc.parent != "" {
+				require.True(t, span.Parent().IsRemote())
+				require.Equal(t, tc.parent, span.Parent().TraceID().String()+"/"+span.Parent().SpanID().String())
+				require.Equal(t, span.Parent().TraceID(), span.SpanContext().TraceID())
+			} else {
+				require.False(t, span.Parent().IsValid())
+			}
+
+			if tc.panic {
+				require.Len(t, span.Events(), 1)
+				require.Equal(t, "exception", span.Events()[0].Name)
+			} else {
+				require.Empty(t, span.Events())
+			}
+
+			var log map[string]any
+			require.NoError(t, json.Unmarshal(out.Bytes(), &log))
+			require.Contains(t, log["logging.googleapis.com/trace"], "/traces/"+span.SpanContext().TraceID().String())
+			require.Equal(t, span.SpanContext().SpanID().String(), log["logging.googleapis.com/spanId"])
+		})
+	}
+}
+
+func TestParseCloudTraceContext(t *testing.T) {
+	tests := []struct {
+		header string
+
+		valid   bool
+		spanID  string
+		sampled bool
+	}{
+		{header: "105445aa7843bc8bf206b12000100000/1;o=1", valid: true, spanID: "0000000000000001", sampled: true},
+		{header: "105445aa7843bc8bf206b12000100000/18446744073709551615;o=0", valid: true, spanID: "ffffffffffffffff"},
+		{header: "105445aa7843bc8bf206b12000100000/123", valid: true, spanID: "000000000000007b"},
+		{header: "105445aa7843bc8bf206b12000100000"},
+		{header: "105445aa7843bc8bf206b12000100000/abc;o=1"},
+		{header: "nottrace/1;o=1"},
+		{header: ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.header, func(t *testing.T) {
+			sc, ok := parseCloudTraceContext(tc.header)
+			require.Equal(t, tc.valid, ok)
+			if !tc.valid {
+				return
+			}
+			require.Equal(t, "105445aa7843bc8bf206b12000100000", sc.TraceID().String())
+			require.Equal(t, tc.spanID, sc.SpanID().String())
+			require.Equal(t, tc.sampled, sc.IsSampled())
+			require.True(t, sc.IsRemote())
+		})
+	}
+}